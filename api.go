@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/sse"
+	"github.com/julienschmidt/httprouter"
+)
+
+// ids are checked before querying, as postgres rejects malformed uuids
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// API serves backup management over JSON, to clients presenting one of Keys
+// as a bearer token.  The health endpoints need no key.
+type API struct {
+	PgBackups *PgBackups
+	Keys      []string
+	// checked by the health endpoints if set
+	Scheduler *Scheduler
+	// how long dashboard sessions last
+	SessionTTL time.Duration
+}
+
+type appSummary struct {
+	AppID      string  `json:"app_id"`
+	AppName    string  `json:"app_name"`
+	LastBackup *Backup `json:"last_backup,omitempty"`
+}
+
+type backupURL struct {
+	URL string `json:"url"`
+}
+
+type restoreRequest struct {
+	// defaults to the app the backup was taken from
+	App string `json:"app"`
+}
+
+func NewAPI(pgb *PgBackups, keys []string) *API {
+	return &API{PgBackups: pgb, Keys: keys, SessionTTL: defaultSessionTTL}
+}
+
+// apiKeys reads the comma separated API_KEYS
+func apiKeys(s string) []string {
+	keys := []string{}
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (a *API) Handler() http.Handler {
+	r := httprouter.New()
+	r.GET("/apps", a.listApps)
+	r.GET("/apps/:app/backups", a.listBackups)
+	r.POST("/apps/:app/backups", a.runBackup)
+	r.POST("/backups", a.runBackups)
+	r.GET("/backups/:id", a.getBackup)
+	r.GET("/backups/:id/url", a.getBackupURL)
+	r.PUT("/backups/:id/pin", a.pinBackup)
+	r.DELETE("/backups/:id/pin", a.unpinBackup)
+	r.POST("/backups/:id/restore", a.restoreBackup)
+	r.POST("/backups/:id/verify", a.verifyBackup)
+	r.POST("/backups/:id/cancel", a.cancelBackup)
+	r.GET("/jobs", a.listJobs)
+	r.GET("/jobs/:id", a.getJob)
+	r.GET("/progress", a.streamProgress)
+	r.GET("/metrics", a.metrics)
+
+	mux := a.healthMux()
+	dashboard := a.dashboardHandler()
+	mux.Handle("/dashboard", dashboard)
+	mux.Handle("/dashboard/", dashboard)
+	mux.Handle("/", a.authenticate(r))
+	return mux
+}
+
+// HealthHandler serves only the health checks, for processes that don't
+// serve the API
+func (a *API) HealthHandler() http.Handler {
+	return a.healthMux()
+}
+
+// ServeHealth serves only the health checks on addr until it fails
+func (a *API) ServeHealth(addr string) error {
+	logger.Info("Serving health checks", "addr", addr)
+	return http.ListenAndServe(addr, a.HealthHandler())
+}
+
+func (a *API) healthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/readyz", a.readyz)
+	return mux
+}
+
+// ListenAndServe serves the API on addr until it fails
+func (a *API) ListenAndServe(addr string) error {
+	if len(a.Keys) == 0 {
+		logger.Warn("API_KEYS is not set, only serving health checks")
+	}
+	logger.Info("Serving API", "addr", addr)
+	return http.ListenAndServe(addr, a.Handler())
+}
+
+func (a *API) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.authorized(req) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pgbackups"`)
+			httphelper.Error(w, httphelper.JSONError{Code: httphelper.UnauthorizedErrorCode, Message: "a valid API key is required"})
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func (a *API) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return a.validKey(strings.TrimPrefix(auth, "Bearer "))
+}
+
+func (a *API) validKey(given string) bool {
+	valid := false
+	// every key is compared, so the time taken doesn't reveal which matched
+	for _, k := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// apiError writes err as the response, treating unknown apps as not found
+func apiError(w http.ResponseWriter, err error) {
+	if err == controller.ErrNotFound {
+		httphelper.ObjectNotFoundError(w, "app not found")
+		return
+	}
+	httphelper.Error(w, err)
+}
+
+func (a *API) listApps(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	apps, err := a.PgBackups.AppsToBackUp()
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	summaries := []*appSummary{}
+	for _, app := range apps {
+		backups, err := a.PgBackups.Repo.GetBackups(app.App.ID)
+		if err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+		s := &appSummary{AppID: app.App.ID, AppName: app.App.Name}
+		if len(backups) > 0 {
+			s.LastBackup = backups[len(backups)-1]
+		}
+		summaries = append(summaries, s)
+	}
+	httphelper.JSON(w, 200, summaries)
+}
+
+func (a *API) listBackups(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	app, err := a.PgBackups.FlynnClient.GetApp(params.ByName("app"))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	backups, err := a.PgBackups.Repo.GetBackups(app.ID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, backups)
+}
+
+func (a *API) runBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	jobs, err := a.PgBackups.EnqueueBackups(TriggerManual, params.ByName("app"))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	httphelper.JSON(w, 202, jobs[0])
+}
+
+func (a *API) runBackups(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	jobs, err := a.PgBackups.EnqueueBackups(TriggerManual, "")
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 202, jobs)
+}
+
+// backup looks up the backup named in the path, writing an error response
+// and returning nil if it can't be found
+func (a *API) backup(w http.ResponseWriter, params httprouter.Params) *Backup {
+	id := params.ByName("id")
+	if !uuidPattern.MatchString(id) {
+		httphelper.ObjectNotFoundError(w, "backup not found")
+		return nil
+	}
+	b, err := a.PgBackups.Repo.GetBackup(id)
+	if err != nil {
+		httphelper.Error(w, err)
+		return nil
+	}
+	if b == nil {
+		httphelper.ObjectNotFoundError(w, "backup not found")
+		return nil
+	}
+	return b
+}
+
+func (a *API) getBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	b := a.backup(w, params)
+	if b == nil {
+		return
+	}
+	// only a single backup comes with its logs, attempts and locations
+	info, err := a.PgBackups.BackupInfo(b)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, info)
+}
+
+func (a *API) getBackupURL(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	b := a.backup(w, params)
+	if b == nil {
+		return
+	}
+	stored, err := a.PgBackups.StoredBackupFor(b)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if stored.Status != BackupStatusCompleted {
+		httphelper.Error(w, errNotCompleted(stored))
+		return
+	}
+	url, err := a.PgBackups.Store.DownloadUrl(stored.AppID, stored.BackupID)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &backupURL{URL: url})
+}
+
+func (a *API) pinBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	a.setPinned(w, params, true)
+}
+
+func (a *API) unpinBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	a.setPinned(w, params, false)
+}
+
+func (a *API) setPinned(w http.ResponseWriter, params httprouter.Params, pinned bool) {
+	b := a.backup(w, params)
+	if b == nil {
+		return
+	}
+	if err := a.PgBackups.Repo.SetPinned(b, pinned); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, b)
+}
+
+func (a *API) restoreBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	b := a.backup(w, params)
+	if b == nil {
+		return
+	}
+	var r restoreRequest
+	if req.ContentLength != 0 {
+		if err := httphelper.DecodeJSON(req, &r); err != nil {
+			httphelper.Error(w, err)
+			return
+		}
+	}
+	j, err := a.PgBackups.EnqueueRestore(b, r.App)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	httphelper.JSON(w, 202, j)
+}
+
+func (a *API) verifyBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	b := a.backup(w, params)
+	if b == nil {
+		return
+	}
+	j, err := a.PgBackups.EnqueueVerify(b)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 202, j)
+}
+
+func (a *API) cancelBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	b := a.backup(w, params)
+	if b == nil {
+		return
+	}
+	if err := a.PgBackups.RequestCancel(b.BackupID); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(202)
+}
+
+func (a *API) listJobs(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	jobs, err := a.PgBackups.Repo.GetJobs(50)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, jobs)
+}
+
+func (a *API) getJob(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+	if !uuidPattern.MatchString(id) {
+		httphelper.ObjectNotFoundError(w, "job not found")
+		return
+	}
+	j, err := a.PgBackups.Repo.GetJob(id)
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	if j == nil {
+		httphelper.ObjectNotFoundError(w, "job not found")
+		return
+	}
+	httphelper.JSON(w, 200, j)
+}
+
+// streamProgress sends the running jobs as server-sent events, polling for
+// the progress their workers write
+func (a *API) streamProgress(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ch := make(chan []*JobProgress)
+	stream := sse.NewStream(w, ch, nil)
+	stream.Serve()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		jobs, err := a.PgBackups.Repo.RunningJobs()
+		if err != nil {
+			logger.Error("Error getting running jobs", "err", err)
+			stream.CloseWithError(err)
+			return
+		}
+		select {
+		case ch <- jobs:
+		case <-stream.Done:
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Done:
+			return
+		}
+	}
+}
+
+// metrics serves the Prometheus text format.  Gauges of the last backups and
+// the counters come from the database, and store operation times from this
+// process.
+func (a *API) metrics(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	backups, err := a.PgBackups.Repo.LatestSuccessfulBackups()
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	counters, err := a.PgBackups.Repo.Counters()
+	if err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeLastBackupMetrics(w, backups)
+	writeCounterMetrics(w, counters)
+	if a.PgBackups.Metrics != nil {
+		a.PgBackups.Metrics.Write(w)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestAPI(t *testing.T) {
+	api, srv := newTestAPI(t, apiKeys("key1, key2"))
+	defer srv.Close()
+	repo := api.PgBackups.Repo
+
+	b, err := repo.NewBackup(random.UUID(), "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(b)
+
+	do := func(method, path, key string, v interface{}) int {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if v != nil && res.StatusCode < 300 {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode
+	}
+
+	for _, key := range []string{"", "wrong"} {
+		if status := do("GET", "/backups/"+b.BackupID, key, nil); status != 401 {
+			t.Errorf("expected 401 with key %q, got %d", key, status)
+		}
+	}
+
+	var got Backup
+	if status := do("GET", "/backups/"+b.BackupID, "key2", &got); status != 200 || got.BackupID != b.BackupID {
+		t.Errorf("expected the backup, got %d %+v", status, got)
+	}
+	for _, id := range []string{random.UUID(), "not-a-uuid"} {
+		if status := do("GET", "/backups/"+id, "key1", nil); status != 404 {
+			t.Errorf("expected 404 for %s, got %d", id, status)
+		}
+	}
+
+	// nothing is stored until the backup completes
+	if status := do("GET", "/backups/"+b.BackupID+"/url", "key1", nil); status != 412 {
+		t.Errorf("expected 412 for the url of a running backup, got %d", status)
+	}
+
+	if status := do("PUT", "/backups/"+b.BackupID+"/pin", "key1", &got); status != 200 || !got.Pinned {
+		t.Errorf("expected the backup to be pinned, got %d %+v", status, got)
+	}
+	if pinned, _ := repo.GetBackup(b.BackupID); pinned == nil || !pinned.Pinned {
+		t.Error("expected the pin to be stored")
+	}
+	if status := do("DELETE", "/backups/"+b.BackupID+"/pin", "key1", &got); status != 200 || got.Pinned {
+		t.Errorf("expected the backup to be unpinned, got %d %+v", status, got)
+	}
+}
+
+func TestRunBackupOnlyBacksUpApps(t *testing.T) {
+	withPostgres := &AppAndRelease{
+		App:     &ct.App{ID: random.UUID(), Name: "with-postgres"},
+		Release: &ct.Release{Env: map[string]string{"FLYNN_POSTGRES": "postgres"}},
+	}
+	withoutPostgres := &AppAndRelease{
+		App:     &ct.App{ID: random.UUID(), Name: "without-postgres"},
+		Release: &ct.Release{Env: map[string]string{}},
+	}
+	api, srv := newTestAPI(t, []string{"key"})
+	defer srv.Close()
+	api.PgBackups.FlynnClient = &FlynnClient{client: newFakeController(withPostgres, withoutPostgres)}
+	defer db.Exec("DELETE FROM pgbackups_jobs WHERE app_id = $1", withPostgres.App.ID)
+
+	run := func(app string) int {
+		req, _ := http.NewRequest("POST", srv.URL+"/apps/"+app+"/backups", nil)
+		req.Header.Set("Authorization", "Bearer key")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	defer os.Unsetenv("APPS")
+	for _, test := range []struct {
+		app, apps string
+		status    int
+	}{
+		{"with-postgres", "", 202},
+		{"without-postgres", "", 400},
+		{"with-postgres", "other", 400},
+		{"missing", "", 404},
+	} {
+		os.Setenv("APPS", test.apps)
+		if status := run(test.app); status != test.status {
+			t.Errorf("expected %d backing up %s with APPS=%q, got %d", test.status, test.app, test.apps, status)
+		}
+	}
+}
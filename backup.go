@@ -5,16 +5,78 @@ import (
 
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
+	"gopkg.in/inconshreveable/log15.v2"
 )
 
 type Backup struct {
-	AppID       string
-	BackupID    string
-	StartedAt   *time.Time
-	CompletedAt *time.Time
-	Bytes       int64
+	AppID       string     `json:"app_id"`
+	AppName     string     `json:"app_name"`
+	BackupID    string     `json:"backup_id"`
+	StartedAt   *time.Time `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Bytes       int64      `json:"bytes"`
+	// hex encoded sha256 of the stored dump
+	Checksum string `json:"checksum,omitempty"`
+	Format   string `json:"format,omitempty"`
+	// read from the dump's header, see ParseDumpHeader
+	Compression   string `json:"compression,omitempty"`
+	PgVersion     string `json:"pg_version,omitempty"`
+	PgDumpVersion string `json:"pg_dump_version,omitempty"`
+	Status        string `json:"status"`
+	// the error from the last failed attempt
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"`
+	// what started the backup, see the Trigger constants
+	Trigger     string     `json:"trigger"`
+	VerifiedAt  *time.Time `json:"verified_at,omitempty"`
+	VerifyError string     `json:"verify_error,omitempty"`
+	// the app's release when the backup was taken, and for backups taken
+	// as a deploy started, the release being deployed
+	ReleaseID       string `json:"release_id,omitempty"`
+	DeployReleaseID string `json:"deploy_release_id,omitempty"`
+	// read from the database before the dump, see FlynnClient.ChangeMarker
+	ChangeMarker string `json:"change_marker,omitempty"`
+	// for unchanged backups, the backup holding the same data
+	SameAs string `json:"same_as,omitempty"`
+	// pinned backups are never deleted by retention
+	Pinned bool `json:"pinned"`
+	// what happened while the backup was taken, and what pg_dump wrote to
+	// stderr on the last attempt, only loaded by LoadBackupLogs as they can
+	// be long
+	Log    string `json:"log,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+
+	// set while the backup is being taken, see startLog
+	log log15.Logger
+}
+
+const (
+	BackupStatusRunning   = "running"
+	BackupStatusCompleted = "completed"
+	BackupStatusFailed    = "failed"
+	BackupStatusCancelled = "cancelled"
+	// nothing was stored, as the database hadn't changed since SameAs
+	BackupStatusUnchanged = "unchanged"
+)
+
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+	TriggerCatchup  = "catchup"
+	TriggerDeploy   = "deploy"
+)
+
+type BackupAttempt struct {
+	BackupID   string     `json:"backup_id"`
+	Attempt    int        `json:"attempt"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Error      string     `json:"error,omitempty"`
+	Retryable  bool       `json:"retryable"`
 }
 
+const backupColumns = "app_id, app_name, backup_id, started_at, completed_at, bytes, checksum, format, status, error, attempts, trigger, verified_at, verify_error, release_id, deploy_release_id, change_marker, same_as, pinned, compression, pg_version, pg_dump_version"
+
 type BackupRepo struct {
 	db *postgres.DB
 }
@@ -26,60 +88,130 @@ func NewBackupRepo(db *postgres.DB) (*BackupRepo, error) {
 	return &BackupRepo{db: db}, nil
 }
 
-func (r *BackupRepo) NewBackup(appID string) (*Backup, error) {
+func (r *BackupRepo) NewBackup(appID string, appName string, trigger string) (*Backup, error) {
+	b := newBackup(appID, appName, trigger)
+	return b, r.InsertBackup(b)
+}
+
+// newBackup returns a running backup, yet to be inserted
+func newBackup(appID string, appName string, trigger string) *Backup {
 	now := time.Now()
-	b := &Backup{
+	return &Backup{
 		AppID:       appID,
+		AppName:     appName,
 		BackupID:    random.UUID(),
 		StartedAt:   &now,
 		CompletedAt: nil,
 		Bytes:       0,
+		Format:      dumpFormat,
+		Status:      BackupStatusRunning,
+		Trigger:     trigger,
 	}
+}
+
+// InsertBackup adds a backup, such as a new one or one read from a manifest
+func (r *BackupRepo) InsertBackup(b *Backup) error {
+	return r.db.Exec("INSERT INTO pgbackups ("+backupColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)",
+		b.AppID, b.AppName, b.BackupID, b.StartedAt, b.CompletedAt, b.Bytes, b.Checksum, b.Format, b.Status, b.Error, b.Attempts, b.Trigger, b.VerifiedAt, b.VerifyError, b.ReleaseID, b.DeployReleaseID, b.ChangeMarker, nullUUID(b.SameAs), b.Pinned, b.Compression, b.PgVersion, b.PgDumpVersion)
+}
 
-	err := r.db.Exec("INSERT INTO pgbackups (app_id, backup_id, started_at, completed_at, bytes) VALUES ($1, $2, $3, $4, $5)",
-		b.AppID, b.BackupID, b.StartedAt, nil, 0)
+// InsertMissingBackup adds a backup unless one with its id exists, returning
+// whether it was added
+func (r *BackupRepo) InsertMissingBackup(b *Backup) (bool, error) {
+	var inserted int
+	err := r.db.QueryRow(`
+	WITH inserted AS (
+		INSERT INTO pgbackups (`+backupColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)
+		ON CONFLICT (backup_id) DO NOTHING
+		RETURNING backup_id
+	)
+	SELECT count(*) FROM inserted`,
+		b.AppID, b.AppName, b.BackupID, b.StartedAt, b.CompletedAt, b.Bytes, b.Checksum, b.Format, b.Status, b.Error, b.Attempts, b.Trigger, b.VerifiedAt, b.VerifyError, b.ReleaseID, b.DeployReleaseID, b.ChangeMarker, nullUUID(b.SameAs), b.Pinned, b.Compression, b.PgVersion, b.PgDumpVersion).Scan(&inserted)
+	return inserted == 1, err
+}
 
-	return b, err
+func (r *BackupRepo) Ping() error {
+	return r.db.Exec("SELECT 1")
+}
+
+func (r *BackupRepo) CountBackups() (int64, error) {
+	var count int64
+	err := r.db.QueryRow("SELECT count(*) FROM pgbackups").Scan(&count)
+	return count, err
 }
 
 func (r *BackupRepo) GetBackup(backupID string) (*Backup, error) {
-	rows, err := r.db.Query("SELECT * FROM pgbackups WHERE backup_id = $1", backupID)
+	backups, err := r.queryBackups("SELECT "+backupColumns+" FROM pgbackups WHERE backup_id = $1", backupID)
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	return backups[0], nil
+}
+
+func (r *BackupRepo) GetBackups(appID string) ([]*Backup, error) {
+	return r.queryBackups("SELECT "+backupColumns+" FROM pgbackups WHERE app_id = $1 ORDER BY started_at ASC", appID)
+}
+
+// LastCompletedBackups returns when the most recent completed (or
+// unchanged) backup of each app was started, by app id
+func (r *BackupRepo) LastCompletedBackups() (map[string]time.Time, error) {
+	rows, err := r.db.Query("SELECT app_id, max(started_at) FROM pgbackups WHERE status IN ($1, $2) GROUP BY app_id", BackupStatusCompleted, BackupStatusUnchanged)
 	if err != nil {
 		return nil, err
 	}
-	// this scanning is repeated to avoid importing pgx and having
-	// deployment/godep errors, as flynn uses godep for pgx (known issues)
 	defer rows.Close()
-	backups := []*Backup{}
+	last := make(map[string]time.Time)
 	for rows.Next() {
-		b := &Backup{}
-		err := rows.Scan(&b.AppID, &b.BackupID, &b.StartedAt, &b.CompletedAt, &b.Bytes)
-		if err != nil {
-			rows.Close()
+		var appID string
+		var startedAt time.Time
+		if err := rows.Scan(&appID, &startedAt); err != nil {
 			return nil, err
 		}
-		backups = append(backups, b)
+		last[appID] = startedAt
 	}
+	return last, rows.Err()
+}
+
+// LastCompletedBackup returns the app's most recent completed backup, or nil
+// if it has none
+func (r *BackupRepo) LastCompletedBackup(appID string) (*Backup, error) {
+	backups, err := r.queryBackups("SELECT "+backupColumns+" FROM pgbackups WHERE app_id = $1 AND status = $2 ORDER BY started_at DESC LIMIT 1", appID, BackupStatusCompleted)
 	if err != nil || len(backups) == 0 {
 		return nil, err
 	}
 	return backups[0], nil
 }
 
-func (r *BackupRepo) GetBackups(appID string) ([]*Backup, error) {
-	rows, err := r.db.Query("SELECT * FROM pgbackups WHERE app_id = $1 ORDER BY started_at ASC", appID)
+// LatestSuccessfulBackups returns the most recent completed (or unchanged)
+// backup of each app
+func (r *BackupRepo) LatestSuccessfulBackups() ([]*Backup, error) {
+	return r.queryBackups("SELECT DISTINCT ON (app_id) "+backupColumns+" FROM pgbackups WHERE status IN ($1, $2) ORDER BY app_id, completed_at DESC", BackupStatusCompleted, BackupStatusUnchanged)
+}
+
+// LastFinishedBackup returns the app's most recent backup that completed, was
+// unchanged or failed, or nil if it has none
+func (r *BackupRepo) LastFinishedBackup(appID string) (*Backup, error) {
+	backups, err := r.queryBackups("SELECT "+backupColumns+" FROM pgbackups WHERE app_id = $1 AND status IN ($2, $3, $4) ORDER BY started_at DESC LIMIT 1", appID, BackupStatusCompleted, BackupStatusUnchanged, BackupStatusFailed)
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	return backups[0], nil
+}
+
+func (r *BackupRepo) GetAllBackups() ([]*Backup, error) {
+	return r.queryBackups("SELECT " + backupColumns + " FROM pgbackups ORDER BY app_id, started_at ASC")
+}
+
+func (r *BackupRepo) queryBackups(query string, args ...interface{}) ([]*Backup, error) {
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
-	// this scanning is repeated to avoid importing pgx and having
-	// deployment/godep errors, as flynn uses godep for pgx (known issues)
 	defer rows.Close()
 	backups := []*Backup{}
 	for rows.Next() {
-		b := &Backup{}
-		err := rows.Scan(&b.AppID, &b.BackupID, &b.StartedAt, &b.CompletedAt, &b.Bytes)
+		b, err := scanBackup(rows)
 		if err != nil {
-			rows.Close()
 			return nil, err
 		}
 		backups = append(backups, b)
@@ -87,15 +219,157 @@ func (r *BackupRepo) GetBackups(appID string) ([]*Backup, error) {
 	return backups, rows.Err()
 }
 
-func (r *BackupRepo) CompleteBackup(b *Backup, bytes int64) error {
+// scanning goes through postgres.Scanner to avoid importing pgx and having
+// deployment/godep errors, as flynn uses godep for pgx (known issues)
+func scanBackup(s postgres.Scanner) (*Backup, error) {
+	b := &Backup{}
+	var appName, checksum, format, sameAs *string
+	err := s.Scan(&b.AppID, &appName, &b.BackupID, &b.StartedAt, &b.CompletedAt, &b.Bytes, &checksum, &format, &b.Status, &b.Error, &b.Attempts, &b.Trigger, &b.VerifiedAt, &b.VerifyError, &b.ReleaseID, &b.DeployReleaseID, &b.ChangeMarker, &sameAs, &b.Pinned, &b.Compression, &b.PgVersion, &b.PgDumpVersion)
+	b.SameAs = nullString(sameAs)
+	b.AppName = nullString(appName)
+	b.Checksum = nullString(checksum)
+	b.Format = nullString(format)
+	return b, err
+}
+
+func nullString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func (r *BackupRepo) CompleteBackup(b *Backup, bytes int64, checksum string) error {
 	now := time.Now()
 	b.CompletedAt = &now
 	b.Bytes = bytes
-	err := r.db.Exec("UPDATE pgbackups SET completed_at = $1, bytes = $2 WHERE backup_id = $3", now, b.Bytes, b.BackupID)
+	b.Checksum = checksum
+	b.Status = BackupStatusCompleted
+	err := r.db.Exec("UPDATE pgbackups SET completed_at = $1, bytes = $2, checksum = $3, status = $4 WHERE backup_id = $5", now, b.Bytes, b.Checksum, b.Status, b.BackupID)
 
 	return err
 }
 
+// UnchangedBackup records a backup as complete without anything stored, as
+// the database is unchanged since same
+func (r *BackupRepo) UnchangedBackup(b *Backup, same *Backup) error {
+	now := time.Now()
+	b.CompletedAt = &now
+	b.Bytes = same.Bytes
+	b.Checksum = same.Checksum
+	b.Status = BackupStatusUnchanged
+	b.SameAs = same.BackupID
+	b.Compression = same.Compression
+	b.PgVersion = same.PgVersion
+	b.PgDumpVersion = same.PgDumpVersion
+	return r.db.Exec("UPDATE pgbackups SET completed_at = $1, bytes = $2, checksum = $3, status = $4, same_as = $5, compression = $6, pg_version = $7, pg_dump_version = $8 WHERE backup_id = $9",
+		now, b.Bytes, b.Checksum, b.Status, b.SameAs, b.Compression, b.PgVersion, b.PgDumpVersion, b.BackupID)
+}
+
+func (r *BackupRepo) FailBackup(b *Backup, cause error) error {
+	return r.endBackup(b, BackupStatusFailed, cause)
+}
+
+func (r *BackupRepo) CancelBackup(b *Backup, cause error) error {
+	return r.endBackup(b, BackupStatusCancelled, cause)
+}
+
+func (r *BackupRepo) endBackup(b *Backup, status string, cause error) error {
+	b.Status = status
+	b.Error = cause.Error()
+	return r.db.Exec("UPDATE pgbackups SET status = $1, error = $2 WHERE backup_id = $3", b.Status, b.Error, b.BackupID)
+}
+
+// RecordAttempt stores the outcome of an attempt at a backup, with a nil
+// cause for success
+func (r *BackupRepo) RecordAttempt(b *Backup, attempt int, startedAt time.Time, cause error) error {
+	b.Attempts = attempt
+	msg := ""
+	if cause != nil {
+		msg = cause.Error()
+	}
+	err := r.db.Exec("INSERT INTO pgbackups_attempts (backup_id, attempt, started_at, error, retryable) VALUES ($1, $2, $3, $4, $5)",
+		b.BackupID, attempt, startedAt, msg, isRetryable(cause))
+	if err != nil {
+		return err
+	}
+	return r.db.Exec("UPDATE pgbackups SET attempts = $1 WHERE backup_id = $2", b.Attempts, b.BackupID)
+}
+
+func (r *BackupRepo) GetAttempts(backupID string) ([]*BackupAttempt, error) {
+	rows, err := r.db.Query("SELECT backup_id, attempt, started_at, finished_at, error, retryable FROM pgbackups_attempts WHERE backup_id = $1 ORDER BY attempt ASC", backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := []*BackupAttempt{}
+	for rows.Next() {
+		a := &BackupAttempt{}
+		if err := rows.Scan(&a.BackupID, &a.Attempt, &a.StartedAt, &a.FinishedAt, &a.Error, &a.Retryable); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// RecordVerification stores the outcome of checking a stored backup against
+// its recorded size and checksum, with a nil cause for success
+func (r *BackupRepo) RecordVerification(b *Backup, cause error) error {
+	now := time.Now()
+	b.VerifiedAt = &now
+	b.VerifyError = ""
+	if cause != nil {
+		b.VerifyError = cause.Error()
+	}
+	return r.db.Exec("UPDATE pgbackups SET verified_at = $1, verify_error = $2 WHERE backup_id = $3", b.VerifiedAt, b.VerifyError, b.BackupID)
+}
+
+func (r *BackupRepo) SetChangeMarker(b *Backup, marker string) error {
+	b.ChangeMarker = marker
+	return r.db.Exec("UPDATE pgbackups SET change_marker = $1 WHERE backup_id = $2", b.ChangeMarker, b.BackupID)
+}
+
+func (r *BackupRepo) SetPinned(b *Backup, pinned bool) error {
+	b.Pinned = pinned
+	return r.db.Exec("UPDATE pgbackups SET pinned = $1 WHERE backup_id = $2", b.Pinned, b.BackupID)
+}
+
+func (r *BackupRepo) UpdateBackupBytes(b *Backup, bytes int64) error {
+	b.Bytes = bytes
+	return r.db.Exec("UPDATE pgbackups SET bytes = $1 WHERE backup_id = $2", b.Bytes, b.BackupID)
+}
+
+func (r *BackupRepo) SetBackupLog(b *Backup, log string) error {
+	b.Log = log
+	return r.db.Exec("UPDATE pgbackups SET log = $1 WHERE backup_id = $2", b.Log, b.BackupID)
+}
+
+func (r *BackupRepo) LoadBackupLogs(b *Backup) error {
+	return r.db.QueryRow("SELECT log, stderr FROM pgbackups WHERE backup_id = $1", b.BackupID).Scan(&b.Log, &b.Stderr)
+}
+
+// SetDumpDetails records what was learned about the dump of an attempt,
+// with a nil header if it couldn't be read
+func (r *BackupRepo) SetDumpDetails(b *Backup, header *DumpHeader, stderr string) error {
+	if header != nil {
+		b.Compression = header.Compression
+		b.PgVersion = header.ServerVersion
+		b.PgDumpVersion = header.PgDumpVersion
+	}
+	b.Stderr = stderr
+	return r.db.Exec("UPDATE pgbackups SET compression = $1, pg_version = $2, pg_dump_version = $3, stderr = $4 WHERE backup_id = $5",
+		b.Compression, b.PgVersion, b.PgDumpVersion, b.Stderr, b.BackupID)
+}
+
 func (r *BackupRepo) DeleteBackup(b *Backup) error {
 	return r.db.Exec("DELETE FROM pgbackups WHERE backup_id = $1", b.BackupID)
 }
+
+func (r *BackupRepo) Notify(channel string, payload string) error {
+	return r.db.Exec("SELECT pg_notify($1, $2)", channel, payload)
+}
+
+func (r *BackupRepo) Listen(channel string, log log15.Logger) (*postgres.Listener, error) {
+	return r.db.Listen(channel, log)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -14,7 +15,7 @@ func TestRepo(t *testing.T) {
 	}
 
 	id := random.UUID()
-	b, err := repo.NewBackup(id)
+	b, err := repo.NewBackup(id, "test", TriggerManual)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -38,7 +39,7 @@ func TestRepo(t *testing.T) {
 		t.Error("could not retrieve backup by id")
 	}
 
-	repo.CompleteBackup(b, 1234)
+	repo.CompleteBackup(b, 1234, "")
 	backups, _ = repo.GetBackups(id)
 	// PG time resolution is lower, so rounding is necessary
 	if backups[0].CompletedAt.Round(time.Second) != b.CompletedAt.Round(time.Second) {
@@ -54,3 +55,82 @@ func TestRepo(t *testing.T) {
 		t.Errorf("expected 0 backups, got %d", len(backups))
 	}
 }
+
+func TestAttempts(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := repo.NewBackup(random.UUID(), "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(b)
+
+	repo.RecordAttempt(b, 1, time.Now(), errors.New("connection reset by peer"))
+	repo.RecordAttempt(b, 2, time.Now(), permanent(errors.New("missing PGHOST in app environment")))
+	repo.FailBackup(b, errors.New("missing PGHOST in app environment"))
+
+	backup, err := repo.GetBackup(b.BackupID)
+	if err != nil || backup == nil {
+		t.Fatal("could not retrieve backup by id")
+	}
+	if backup.Status != BackupStatusFailed || backup.Attempts != 2 || backup.Error == "" {
+		t.Errorf("expected failed backup with 2 attempts, got %+v", backup)
+	}
+
+	attempts, err := repo.GetAttempts(b.BackupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(attempts))
+	}
+	if !attempts[0].Retryable || attempts[1].Retryable {
+		t.Errorf("expected only the first attempt to be retryable, got %t %t", attempts[0].Retryable, attempts[1].Retryable)
+	}
+}
+
+func TestUnchangedBackup(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appID := random.UUID()
+	if last, err := repo.LastCompletedBackup(appID); err != nil || last != nil {
+		t.Fatalf("expected no completed backup, got %+v %v", last, err)
+	}
+
+	b, err := repo.NewBackup(appID, "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(b)
+	repo.SetChangeMarker(b, "1|2|3")
+	repo.CompleteBackup(b, 1234, "abc123")
+
+	last, err := repo.LastCompletedBackup(appID)
+	if err != nil || last == nil || last.BackupID != b.BackupID || last.ChangeMarker != "1|2|3" {
+		t.Fatalf("expected the completed backup with its marker, got %+v %v", last, err)
+	}
+
+	u, err := repo.NewBackup(appID, "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(u)
+	if err := repo.UnchangedBackup(u, last); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = repo.GetBackup(u.BackupID)
+	if u.Status != BackupStatusUnchanged || u.SameAs != b.BackupID || u.Bytes != 1234 || u.Checksum != "abc123" {
+		t.Errorf("expected an unchanged backup the same as %s, got %+v", b.BackupID, u)
+	}
+
+	// unchanged backups hold no data, so aren't the last completed
+	if last, _ := repo.LastCompletedBackup(appID); last == nil || last.BackupID != b.BackupID {
+		t.Errorf("expected %s to still be the last completed backup, got %+v", b.BackupID, last)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/robfig/cron"
+)
+
+// Blackout is a window in which backups don't run, either recurring (each
+// run of Schedule, lasting Duration) or one-off (from StartsAt to EndsAt).
+// It applies to every app unless AppID is set.
+type Blackout struct {
+	BlackoutID string
+	AppID      string
+	Schedule   string
+	Duration   time.Duration
+	StartsAt   *time.Time
+	EndsAt     *time.Time
+	Reason     string
+	CreatedAt  *time.Time
+
+	sched cron.Schedule
+}
+
+// Validate checks the blackout describes exactly one kind of window
+func (b *Blackout) Validate() error {
+	if b.Schedule != "" {
+		if b.StartsAt != nil || b.EndsAt != nil {
+			return errors.New("a blackout has either a schedule or a start and end, not both")
+		}
+		if b.Duration < time.Second {
+			return errors.New("a recurring blackout needs a duration of at least a second")
+		}
+		if _, err := cron.Parse(b.Schedule); err != nil {
+			return err
+		}
+		return nil
+	}
+	if b.StartsAt == nil || b.EndsAt == nil {
+		return errors.New("a blackout needs a schedule and duration, or a start and end")
+	}
+	if !b.EndsAt.After(*b.StartsAt) {
+		return errors.New("a blackout must end after it starts")
+	}
+	return nil
+}
+
+// end returns the end of the window t is in, if it is in one
+func (b *Blackout) end(t time.Time) (time.Time, bool) {
+	if b.Schedule == "" {
+		if !t.Before(*b.StartsAt) && t.Before(*b.EndsAt) {
+			return *b.EndsAt, true
+		}
+		return time.Time{}, false
+	}
+
+	if b.sched == nil {
+		sched, err := cron.Parse(b.Schedule)
+		if err != nil {
+			// validated when added, so only a hand edited row gets here
+			return time.Time{}, false
+		}
+		b.sched = sched
+	}
+	// the first window starting after t-Duration is the only one that can
+	// still be open at t
+	start := b.sched.Next(t.Add(-b.Duration))
+	if start.After(t) {
+		return time.Time{}, false
+	}
+	return start.Add(b.Duration), true
+}
+
+// blackoutEnd returns when the app's backups may next run, if t falls in any
+// of the blackouts that apply to it.  Overlapping and back to back windows
+// are followed through to the end of the last.
+func blackoutEnd(blackouts []*Blackout, appID string, t time.Time) (time.Time, bool) {
+	blocked := false
+	// capped, as a recurring window as long as its schedule never ends
+	for i := 0; i < 100; i++ {
+		extended := false
+		for _, b := range blackouts {
+			if b.AppID != "" && b.AppID != appID {
+				continue
+			}
+			if end, ok := b.end(t); ok {
+				t = end
+				blocked, extended = true, true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	return t, blocked
+}
+
+// blackoutApplies returns whether the job waits for blackouts to end.
+// Restores and verifications are asked for by hand, so run regardless, and
+// deploy backups are only useful before the deploy migrates the database.
+func blackoutApplies(j *Job) bool {
+	if j.Trigger == TriggerDeploy {
+		return false
+	}
+	return j.Kind == JobKindBackup || j.Kind == JobKindSelfBackup
+}
+
+// deferForBlackout puts the job back in the queue until the end of any
+// blackout it is claimed in, returning whether it was deferred
+func (pgb *PgBackups) deferForBlackout(j *Job) (bool, error) {
+	if !blackoutApplies(j) {
+		return false, nil
+	}
+	blackouts, err := pgb.Repo.GetBlackouts()
+	if err != nil {
+		return false, err
+	}
+	end, blocked := blackoutEnd(blackouts, j.AppID, time.Now())
+	if !blocked {
+		return false, nil
+	}
+	return true, pgb.Repo.DeferJob(j, end)
+}
+
+func (r *BackupRepo) AddBlackout(b *Blackout) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	now := time.Now()
+	b.BlackoutID = random.UUID()
+	b.CreatedAt = &now
+	return r.db.Exec("INSERT INTO pgbackups_blackouts (blackout_id, app_id, schedule, duration_seconds, starts_at, ends_at, reason, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		b.BlackoutID, nullUUID(b.AppID), b.Schedule, int(b.Duration/time.Second), b.StartsAt, b.EndsAt, b.Reason, b.CreatedAt)
+}
+
+func (r *BackupRepo) RemoveBlackout(blackoutID string) error {
+	return r.db.Exec("DELETE FROM pgbackups_blackouts WHERE blackout_id = $1", blackoutID)
+}
+
+func (r *BackupRepo) GetBlackouts() ([]*Blackout, error) {
+	rows, err := r.db.Query("SELECT blackout_id, app_id, schedule, duration_seconds, starts_at, ends_at, reason, created_at FROM pgbackups_blackouts ORDER BY created_at ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blackouts := []*Blackout{}
+	for rows.Next() {
+		b, err := scanBlackout(rows)
+		if err != nil {
+			return nil, err
+		}
+		blackouts = append(blackouts, b)
+	}
+	return blackouts, rows.Err()
+}
+
+func scanBlackout(s postgres.Scanner) (*Blackout, error) {
+	b := &Blackout{}
+	var appID *string
+	var seconds int
+	err := s.Scan(&b.BlackoutID, &appID, &b.Schedule, &seconds, &b.StartsAt, &b.EndsAt, &b.Reason, &b.CreatedAt)
+	b.AppID = nullString(appID)
+	b.Duration = time.Duration(seconds) * time.Second
+	return b, err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlackoutEnd(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2016, 3, day, hour, min, 0, 0, time.Local)
+	}
+	from, to := at(10, 4, 0), at(10, 6, 0)
+	blackouts := []*Blackout{
+		// weekday peak hours, 9am to 5pm
+		{Schedule: "0 0 9 * * 1-5", Duration: 8 * time.Hour},
+		// an upgrade, straight after which this app's own window starts
+		{StartsAt: &from, EndsAt: &to},
+		{AppID: "app", Schedule: "0 0 6 * * *", Duration: 30 * time.Minute},
+	}
+	for _, b := range blackouts {
+		if err := b.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		appID   string
+		t       time.Time
+		end     time.Time
+		blocked bool
+	}{
+		{"other", at(10, 3, 0), at(10, 3, 0), false},
+		{"other", at(10, 5, 0), at(10, 6, 0), true},
+		{"app", at(10, 5, 0), at(10, 6, 30), true},
+		{"app", at(12, 6, 10), at(12, 6, 30), true},
+		// thursday and saturday
+		{"other", at(10, 12, 0), at(10, 17, 0), true},
+		{"other", at(12, 12, 0), at(12, 12, 0), false},
+		{"other", at(10, 17, 0), at(10, 17, 0), false},
+	} {
+		end, blocked := blackoutEnd(blackouts, c.appID, c.t)
+		if blocked != c.blocked || !end.Equal(c.end) {
+			t.Errorf("%s at %s: expected %t until %s, got %t until %s", c.appID, c.t, c.blocked, c.end, blocked, end)
+		}
+	}
+}
+
+func TestBlackoutValidate(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+	for _, b := range []*Blackout{
+		{},
+		{Schedule: "0 0 9 * * *"},
+		{Schedule: "not a schedule", Duration: time.Hour},
+		{Schedule: "0 0 9 * * *", Duration: time.Hour, StartsAt: &earlier, EndsAt: &now},
+		{StartsAt: &now, EndsAt: &earlier},
+		{StartsAt: &now},
+	} {
+		if err := b.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", b)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+// cancel requests are sent to every process through postgres, as the
+// backup may be running in any of them
+const cancelChannel = "pgbackups_cancel"
+
+var (
+	errBackupCancelled = permanent(errors.New("backup cancelled"))
+	errWorkerShutdown  = permanent(errors.New("backup cancelled, worker shut down"))
+)
+
+// runningBackups tracks the backups running in this process, so that they
+// can be cancelled
+type runningBackups struct {
+	mtx     sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}
+
+func (r *runningBackups) add(backupID string, cancel context.CancelCauseFunc) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.cancels == nil {
+		r.cancels = make(map[string]context.CancelCauseFunc)
+	}
+	r.cancels[backupID] = cancel
+}
+
+func (r *runningBackups) remove(backupID string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.cancels, backupID)
+}
+
+func (r *runningBackups) count() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return len(r.cancels)
+}
+
+func (r *runningBackups) cancelAll(cause error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, cancel := range r.cancels {
+		cancel(cause)
+	}
+}
+
+func (r *runningBackups) cancel(backupID string, cause error) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	cancel, ok := r.cancels[backupID]
+	if ok {
+		cancel(cause)
+	}
+	return ok
+}
+
+// track registers work running under id, returning a context that is
+// cancelled by cancel requests and shutdown, and a func to call when done
+func (pgb *PgBackups) track(ctx context.Context, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	pgb.running.add(id, cancel)
+	return ctx, func() {
+		pgb.running.remove(id)
+		cancel(nil)
+	}
+}
+
+// RequestCancel asks whichever process is running the backup to cancel it
+func (pgb *PgBackups) RequestCancel(backupID string) error {
+	b, err := pgb.Repo.GetBackup(backupID)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return errors.New("backup not found")
+	}
+	if b.Status != BackupStatusRunning {
+		return httphelper.PreconditionFailedErr("backup is not running, it is " + b.Status)
+	}
+	return pgb.Repo.Notify(cancelChannel, backupID)
+}
+
+// ListenForCancels cancels running backups as requests are received, until
+// ctx is done
+func (pgb *PgBackups) ListenForCancels(ctx context.Context) {
+	for {
+		l, err := pgb.Repo.Listen(cancelChannel, logger.New("component", "cancel-listener"))
+		if err != nil {
+			logger.Error("Error listening for cancel requests", "err", err)
+		} else {
+		receive:
+			for {
+				select {
+				case <-ctx.Done():
+					l.Close()
+					return
+				case n, ok := <-l.Notify:
+					if !ok {
+						logger.Error("Error listening for cancel requests", "err", l.Err)
+						break receive
+					}
+					if pgb.running.cancel(n.Payload, errBackupCancelled) {
+						logger.Info("Cancelling backup", "backup_id", n.Payload)
+					}
+				}
+			}
+		}
+
+		// reconnect
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestCancel(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgb := &PgBackups{Repo: repo}
+
+	b, err := repo.NewBackup(random.UUID(), "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(b)
+
+	backupCtx, cancelBackup := context.WithCancelCause(context.Background())
+	pgb.running.add(b.BackupID, cancelBackup)
+	defer pgb.running.remove(b.BackupID)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go pgb.ListenForCancels(ctx)
+
+	// requests sent before the listener is ready are missed, so keep asking
+	timeout := time.After(10 * time.Second)
+	for backupCtx.Err() == nil {
+		if err := pgb.RequestCancel(b.BackupID); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-backupCtx.Done():
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for the backup to be cancelled")
+		}
+	}
+	if context.Cause(backupCtx) != errBackupCancelled {
+		t.Errorf("expected cause %s, got %s", errBackupCancelled, context.Cause(backupCtx))
+	}
+
+	repo.CompleteBackup(b, 0, "")
+	if err := pgb.RequestCancel(b.BackupID); err == nil {
+		t.Error("expected cancelling a completed backup to fail")
+	}
+}
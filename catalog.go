@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+)
+
+// Manifest describes a stored backup, and is written next to it
+type Manifest struct {
+	AppID       string     `json:"app_id"`
+	AppName     string     `json:"app_name"`
+	BackupID    string     `json:"backup_id"`
+	StartedAt   *time.Time `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Bytes       int64      `json:"bytes"`
+	Checksum    string     `json:"checksum"`
+	Format      string     `json:"format"`
+	Trigger     string     `json:"trigger"`
+	// omitted when empty, as they are only known for some backups
+	ReleaseID       string `json:"release_id,omitempty"`
+	DeployReleaseID string `json:"deploy_release_id,omitempty"`
+	Compression     string `json:"compression,omitempty"`
+	PgVersion       string `json:"pg_version,omitempty"`
+	PgDumpVersion   string `json:"pg_dump_version,omitempty"`
+}
+
+func newManifest(b *Backup) *Manifest {
+	return &Manifest{
+		AppID:       b.AppID,
+		AppName:     b.AppName,
+		BackupID:    b.BackupID,
+		StartedAt:   b.StartedAt,
+		CompletedAt: b.CompletedAt,
+		Bytes:       b.Bytes,
+		Checksum:    b.Checksum,
+		Format:      b.Format,
+		Trigger:     b.Trigger,
+
+		ReleaseID:       b.ReleaseID,
+		DeployReleaseID: b.DeployReleaseID,
+		Compression:     b.Compression,
+		PgVersion:       b.PgVersion,
+		PgDumpVersion:   b.PgDumpVersion,
+	}
+}
+
+func (m *Manifest) Backup() *Backup {
+	trigger := m.Trigger
+	if trigger == "" {
+		// written before triggers were recorded
+		trigger = TriggerSchedule
+	}
+	return &Backup{
+		AppID:       m.AppID,
+		AppName:     m.AppName,
+		BackupID:    m.BackupID,
+		StartedAt:   m.StartedAt,
+		CompletedAt: m.CompletedAt,
+		Bytes:       m.Bytes,
+		Checksum:    m.Checksum,
+		Format:      m.Format,
+		Trigger:     trigger,
+
+		ReleaseID:       m.ReleaseID,
+		DeployReleaseID: m.DeployReleaseID,
+		Compression:     m.Compression,
+		PgVersion:       m.PgVersion,
+		PgDumpVersion:   m.PgDumpVersion,
+		// only completed backups have manifests
+		Status: BackupStatusCompleted,
+	}
+}
+
+// RebuildCatalog restores the rows of stored backups that have none from
+// their manifests, returning the number of backups restored and the number
+// of stored backups that had no readable manifest.  Backups that already
+// have a row are left alone, so it can be run once backups have started
+// again on a new database.
+func (pgb *PgBackups) RebuildCatalog() (int, int, error) {
+	stored, err := pgb.Store.List()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	backups, err := pgb.Repo.GetAllBackups()
+	if err != nil {
+		return 0, 0, err
+	}
+	rows := make(map[string]bool, len(backups))
+	for _, b := range backups {
+		rows[b.BackupID] = true
+	}
+
+	restored, missing := 0, 0
+	for _, o := range stored {
+		if rows[o.BackupID] {
+			continue
+		}
+		m, err := pgb.Store.GetManifest(o.AppID, o.BackupID)
+		if err != nil {
+			logger.Error("Error reading manifest", "app_id", o.AppID, "backup_id", o.BackupID, "err", err)
+			missing++
+			continue
+		}
+		inserted, err := pgb.Repo.InsertMissingBackup(m.Backup())
+		if err != nil {
+			return restored, missing, err
+		}
+		if inserted {
+			restored++
+		}
+	}
+
+	return restored, missing, nil
+}
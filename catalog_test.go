@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestRebuildCatalog(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups"); err != nil {
+		t.Fatal(err)
+	}
+	store := newMemStore()
+	pgb := &PgBackups{Repo: repo, Store: store}
+
+	appID := random.UUID()
+	b, err := repo.NewBackup(appID, "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(context.Background(), appID, b.BackupID, strings.NewReader("dump"))
+	repo.CompleteBackup(b, 4, "abc123")
+	store.PutManifest(newManifest(b))
+	// no manifest for this one
+	store.Put(context.Background(), appID, random.UUID(), strings.NewReader("dump"))
+
+	// backups with rows are left alone
+	if restored, _, err := pgb.RebuildCatalog(); err != nil || restored != 0 {
+		t.Errorf("expected nothing to be restored, got %d, %v", restored, err)
+	}
+
+	repo.DeleteBackup(b)
+	// such as one started on the new database before the rebuild
+	started, err := repo.NewBackup(appID, "test", TriggerCatchup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(started)
+	restored, missing, err := pgb.RebuildCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 || missing != 1 {
+		t.Errorf("expected 1 restored and 1 missing, got %d and %d", restored, missing)
+	}
+
+	rebuilt, err := repo.GetBackup(b.BackupID)
+	if err != nil || rebuilt == nil {
+		t.Fatal("could not retrieve rebuilt backup")
+	}
+	if rebuilt.AppName != "test" || rebuilt.Bytes != 4 || rebuilt.Checksum != "abc123" || rebuilt.Format != dumpFormat {
+		t.Errorf("rebuilt backup did not match: %+v", rebuilt)
+	}
+
+	repo.DeleteBackup(rebuilt)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// policies for scheduled runs missed while no worker was leading
+const (
+	// back up each app that missed a run once, however many it missed
+	CatchupOnce = "once"
+	// wait for the next scheduled run
+	CatchupSkip = "skip"
+)
+
+// catchUp queues backups of the apps that have missed a scheduled run,
+// unless the policy is to skip them
+func (s *Scheduler) catchUp() {
+	if s.CatchupPolicy == CatchupSkip {
+		logger.Info("Skipping catch-up of missed backups")
+		return
+	}
+	// every app looks overdue without any records, such as when the
+	// database has been lost, and the rows of catch-up backups would be in
+	// the catalog before it could be rebuilt, so the scheduled runs are
+	// left to back apps up instead
+	count, err := s.PgBackups.Repo.CountBackups()
+	if err != nil {
+		logger.Error("Error counting backups for catch-up", "err", err)
+		return
+	}
+	if count == 0 {
+		logger.Info("Skipping catch-up, as there are no backups recorded")
+		return
+	}
+
+	sched, err := cron.Parse(s.CronLine)
+	if err != nil {
+		logger.Error("Error parsing schedule for catch-up", "err", err)
+		return
+	}
+
+	jobs, err := s.PgBackups.EnqueueCatchups(sched, s.Window, time.Now())
+	if err != nil {
+		logger.Error("Error queueing catch-up backups", "err", err)
+	}
+	if len(jobs) > 0 {
+		logger.Info("Queued catch-up backups", "count", len(jobs))
+	}
+}
+
+// EnqueueCatchups queues a backup of each app that has missed a run of the
+// schedule, spread over window, before now and doesn't already have a backup
+// queued or running
+func (pgb *PgBackups) EnqueueCatchups(sched cron.Schedule, window time.Duration, now time.Time) ([]*Job, error) {
+	apps, err := pgb.AppsToBackUp()
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := pgb.Repo.LastCompletedBackups()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pgb.Repo.PendingJobApps(JobKindBackup)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*Job{}
+	for _, a := range overdueApps(apps, last, sched, window, now) {
+		if pending[a.App.ID] {
+			continue
+		}
+		j := newAppJob(JobKindBackup, a, TriggerCatchup)
+		if err := pgb.Repo.EnqueueJob(j); err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// overdueApps returns the apps whose last completed backup, by app id in
+// last, was started before their most recent run of the schedule.  Apps
+// never backed up are overdue.
+func overdueApps(apps []*AppAndRelease, last map[string]time.Time, sched cron.Schedule, window time.Duration, now time.Time) []*AppAndRelease {
+	overdue := []*AppAndRelease{}
+	for _, a := range apps {
+		t, ok := last[a.App.ID]
+		if !ok || !nextRun(sched, appOffset(a.App.ID, window), t).After(now) {
+			overdue = append(overdue, a)
+		}
+	}
+	return overdue
+}
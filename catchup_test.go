@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/robfig/cron"
+)
+
+func TestOverdueApps(t *testing.T) {
+	sched, err := cron.Parse(defaultCronLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5am runs, checked at noon
+	now := time.Date(2016, 3, 10, 12, 0, 0, 0, time.Local)
+	apps := []*AppAndRelease{
+		{App: &ct.App{ID: "today"}},
+		{App: &ct.App{ID: "yesterday"}},
+		{App: &ct.App{ID: "last-week"}},
+		{App: &ct.App{ID: "never"}},
+	}
+	last := map[string]time.Time{
+		"today":     time.Date(2016, 3, 10, 5, 0, 1, 0, time.Local),
+		"yesterday": time.Date(2016, 3, 9, 5, 0, 1, 0, time.Local),
+		"last-week": time.Date(2016, 3, 3, 5, 0, 1, 0, time.Local),
+	}
+
+	overdue := overdueApps(apps, last, sched, 0, now)
+	ids := []string{}
+	for _, a := range overdue {
+		ids = append(ids, a.App.ID)
+	}
+	if len(ids) != 3 || ids[0] != "yesterday" || ids[1] != "last-week" || ids[2] != "never" {
+		t.Errorf("expected yesterday, last-week and never to be overdue, got %v", ids)
+	}
+}
+
+func TestCatchupPolicyFromEnv(t *testing.T) {
+	defer os.Unsetenv("CATCHUP_POLICY")
+	for _, test := range []struct {
+		env, policy string
+	}{
+		{"", CatchupOnce},
+		{"skip", CatchupSkip},
+		{"once", CatchupOnce},
+	} {
+		os.Setenv("CATCHUP_POLICY", test.env)
+		s, err := newSchedulerFromEnv(&PgBackups{})
+		if err != nil || s.CatchupPolicy != test.policy {
+			t.Errorf("expected %q from %q, got %v, %v", test.policy, test.env, s, err)
+		}
+	}
+
+	// a typo would otherwise mean catching up when asked not to
+	os.Setenv("CATCHUP_POLICY", "skp")
+	if _, err := newSchedulerFromEnv(&PgBackups{}); err == nil {
+		t.Error("expected an unknown policy to be refused")
+	}
+}
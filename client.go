@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/sse"
+)
+
+const clientPollInterval = 2 * time.Second
+
+var errNoClientURL = errors.New("the API url must be given with --url, PGBACKUPS_URL or the config file")
+
+// Client calls the API served by the web process
+type Client struct {
+	URL  string
+	Key  string
+	HTTP *http.Client
+}
+
+// ClientConfig is where the client finds the API, read from a JSON file
+// then overridden by the environment and flags
+type ClientConfig struct {
+	URL string `json:"url"`
+	Key string `json:"key"`
+}
+
+func NewClient(url string, key string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), Key: key, HTTP: http.DefaultClient}
+}
+
+// defaultClientConfigPath is ~/.flynn-pgbackups.json unless PGBACKUPS_CONFIG
+// names another file
+func defaultClientConfigPath() string {
+	if path := os.Getenv("PGBACKUPS_CONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".flynn-pgbackups.json")
+}
+
+// LoadClientConfig reads the config file at path, if there is one, then
+// applies PGBACKUPS_URL and PGBACKUPS_KEY and finally the given flag values
+func LoadClientConfig(path string, flagURL string, flagKey string) (*ClientConfig, error) {
+	config := &ClientConfig{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, config); err != nil {
+				return nil, fmt.Errorf("error reading %s: %s", path, err)
+			}
+		}
+	}
+	for _, v := range []struct {
+		field *string
+		env   string
+		flag  string
+	}{
+		{&config.URL, os.Getenv("PGBACKUPS_URL"), flagURL},
+		{&config.Key, os.Getenv("PGBACKUPS_KEY"), flagKey},
+	} {
+		if v.env != "" {
+			*v.field = v.env
+		}
+		if v.flag != "" {
+			*v.field = v.flag
+		}
+	}
+	if config.URL == "" {
+		return nil, errNoClientURL
+	}
+	return config, nil
+}
+
+// do sends in as the JSON body of the request, if it isn't nil, and decodes
+// the response into out
+func (c *Client) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *Client) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+	return req, nil
+}
+
+// send returns error responses as httphelper.JSONError
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		var jsonErr httphelper.JSONError
+		if err := json.NewDecoder(res.Body).Decode(&jsonErr); err != nil || jsonErr.Message == "" {
+			return nil, fmt.Errorf("unexpected response from %s %s: %s", req.Method, req.URL.Path, res.Status)
+		}
+		return nil, jsonErr
+	}
+	return res, nil
+}
+
+func (c *Client) Apps() ([]*appSummary, error) {
+	var apps []*appSummary
+	return apps, c.do("GET", "/apps", nil, &apps)
+}
+
+func (c *Client) Backups(appName string) ([]*Backup, error) {
+	var backups []*Backup
+	return backups, c.do("GET", "/apps/"+url.PathEscape(appName)+"/backups", nil, &backups)
+}
+
+func (c *Client) Backup(id string) (*BackupInfo, error) {
+	info := &BackupInfo{}
+	return info, c.do("GET", "/backups/"+url.PathEscape(id), nil, info)
+}
+
+// Capture queues a backup of the app
+func (c *Client) Capture(appName string) (*Job, error) {
+	j := &Job{}
+	return j, c.do("POST", "/apps/"+url.PathEscape(appName)+"/backups", nil, j)
+}
+
+func (c *Client) BackupURL(id string) (string, error) {
+	u := &backupURL{}
+	return u.URL, c.do("GET", "/backups/"+url.PathEscape(id)+"/url", nil, u)
+}
+
+// Download writes the stored backup to w, fetching it straight from the
+// store with a signed url
+func (c *Client) Download(id string, w io.Writer) (int64, error) {
+	u, err := c.BackupURL(id)
+	if err != nil {
+		return 0, err
+	}
+	res, err := c.HTTP.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, fmt.Errorf("unexpected response downloading backup %s: %s", id, res.Status)
+	}
+	return io.Copy(w, res.Body)
+}
+
+// Restore queues a restore of the backup into the named app, or the app it
+// was taken from if appName is empty
+func (c *Client) Restore(id string, appName string) (*Job, error) {
+	j := &Job{}
+	return j, c.do("POST", "/backups/"+url.PathEscape(id)+"/restore", &restoreRequest{App: appName}, j)
+}
+
+func (c *Client) Cancel(id string) error {
+	return c.do("POST", "/backups/"+url.PathEscape(id)+"/cancel", nil, nil)
+}
+
+func (c *Client) Job(id string) (*Job, error) {
+	j := &Job{}
+	return j, c.do("GET", "/jobs/"+url.PathEscape(id), nil, j)
+}
+
+// WaitForJob polls the job until it has finished
+func (c *Client) WaitForJob(id string) (*Job, error) {
+	for {
+		j, err := c.Job(id)
+		if err != nil {
+			return nil, err
+		}
+		if j.Status == JobStatusSucceeded || j.Status == JobStatusFailed {
+			return j, nil
+		}
+		time.Sleep(clientPollInterval)
+	}
+}
+
+// Progress calls fn with the running jobs each time the API sends them,
+// until fn returns false or the stream ends
+func (c *Client) Progress(fn func([]*JobProgress) bool) error {
+	req, err := c.newRequest("GET", "/progress", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := sse.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var jobs []*JobProgress
+		if err := dec.Decode(&jobs); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !fn(jobs) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const clientUsage = `usage: flynn-pgbackups client [--url url] [--key key] [--json] command [args]
+
+commands:
+  list [app-name]                 list apps, or the backups of an app
+  info backup-id                  show a backup
+  capture [--wait] app-name       queue a backup of an app
+  url backup-id                   get a temporary download url for a backup
+  download [-o file] backup-id    download a backup
+  restore [--wait] backup-id [app-name]
+                                  queue a restore of a backup
+  cancel backup-id                cancel a running backup
+  progress [--follow]             show the progress of running jobs
+`
+
+// clientCmd runs the client commands, which call the API of a running
+// web process rather than connecting to the database
+type clientCmd struct {
+	client *Client
+	json   bool
+	out    io.Writer
+}
+
+func runClient(args []string) {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, clientUsage) }
+	apiURL := flags.String("url", "", "the API url, overriding PGBACKUPS_URL")
+	key := flags.String("key", "", "the API key, overriding PGBACKUPS_KEY")
+	configPath := flags.String("config", defaultClientConfigPath(), "a JSON file with the url and key")
+	asJSON := flags.Bool("json", false, "print JSON rather than tables")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	config, err := LoadClientConfig(*configPath, *apiURL, *key)
+	if err != nil {
+		clientFatal(err)
+	}
+
+	c := &clientCmd{client: NewClient(config.URL, config.Key), json: *asJSON, out: os.Stdout}
+	if err := c.run(flags.Arg(0), flags.Args()[1:]); err != nil {
+		clientFatal(err)
+	}
+}
+
+func clientFatal(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	os.Exit(1)
+}
+
+func (c *clientCmd) run(command string, args []string) error {
+	switch command {
+	case "list":
+		if len(args) == 0 {
+			return c.listApps()
+		}
+		return c.listBackups(args[0])
+	case "info":
+		if len(args) == 0 {
+			return errUsage("info backup-id")
+		}
+		return c.info(args[0])
+	case "capture":
+		flags := flag.NewFlagSet("capture", flag.ExitOnError)
+		wait := flags.Bool("wait", false, "wait for the backup to finish")
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return errUsage("capture [--wait] app-name")
+		}
+		return c.capture(flags.Arg(0), *wait)
+	case "url":
+		if len(args) == 0 {
+			return errUsage("url backup-id")
+		}
+		return c.url(args[0])
+	case "download":
+		flags := flag.NewFlagSet("download", flag.ExitOnError)
+		output := flags.String("o", "", "the file to write, defaulting to [backup-id].dump")
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return errUsage("download [-o file] backup-id")
+		}
+		return c.download(flags.Arg(0), *output)
+	case "restore":
+		flags := flag.NewFlagSet("restore", flag.ExitOnError)
+		wait := flags.Bool("wait", false, "wait for the restore to finish")
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return errUsage("restore [--wait] backup-id [app-name]")
+		}
+		return c.restore(flags.Arg(0), flags.Arg(1), *wait)
+	case "cancel":
+		if len(args) == 0 {
+			return errUsage("cancel backup-id")
+		}
+		return c.cancel(args[0])
+	case "progress":
+		flags := flag.NewFlagSet("progress", flag.ExitOnError)
+		follow := flags.Bool("follow", false, "keep showing progress until interrupted")
+		flags.Parse(args)
+		return c.progress(*follow)
+	default:
+		return fmt.Errorf("unknown command %q, see flynn-pgbackups client --help", command)
+	}
+}
+
+func errUsage(usage string) error {
+	return fmt.Errorf("usage: flynn-pgbackups client %s", usage)
+}
+
+func (c *clientCmd) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *clientCmd) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+}
+
+func (c *clientCmd) listApps() error {
+	apps, err := c.client.Apps()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(apps)
+	}
+	w := c.table()
+	fmt.Fprintln(w, "APP\tID\tLAST BACKUP\tSTATUS\tSIZE")
+	for _, a := range apps {
+		if b := a.LastBackup; b != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", a.AppName, a.AppID, formatTime(b.StartedAt), b.Status, formatBytes(b.Bytes))
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\n", a.AppName, a.AppID)
+		}
+	}
+	return w.Flush()
+}
+
+func (c *clientCmd) listBackups(appName string) error {
+	backups, err := c.client.Backups(appName)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(backups)
+	}
+	w := c.table()
+	fmt.Fprintln(w, "ID\tSTARTED\tCOMPLETED\tSIZE\tSTATUS\tTRIGGER\tPINNED")
+	for _, b := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%t\n", b.BackupID, formatTime(b.StartedAt), formatTime(b.CompletedAt), formatBytes(b.Bytes), b.Status, b.Trigger, b.Pinned)
+	}
+	return w.Flush()
+}
+
+func (c *clientCmd) info(id string) error {
+	info, err := c.client.Backup(id)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(info)
+	}
+	return writeBackupInfo(c.out, info)
+}
+
+func (c *clientCmd) capture(appName string, wait bool) error {
+	j, err := c.client.Capture(appName)
+	if err != nil {
+		return err
+	}
+	return c.queued(j, wait)
+}
+
+func (c *clientCmd) restore(id string, appName string, wait bool) error {
+	j, err := c.client.Restore(id, appName)
+	if err != nil {
+		return err
+	}
+	return c.queued(j, wait)
+}
+
+// queued reports a queued job, waiting for it to finish if asked to
+func (c *clientCmd) queued(j *Job, wait bool) error {
+	if wait {
+		var err error
+		if j, err = c.client.WaitForJob(j.JobID); err != nil {
+			return err
+		}
+	}
+	if c.json {
+		if err := c.printJSON(j); err != nil {
+			return err
+		}
+	} else if !wait {
+		fmt.Fprintf(c.out, "Queued %s job %s\n", j.Kind, j.JobID)
+	} else {
+		fmt.Fprintf(c.out, "%s job %s %s\n", j.Kind, j.JobID, j.Status)
+	}
+	if j.Status == JobStatusFailed {
+		return fmt.Errorf("%s job failed: %s", j.Kind, j.Error)
+	}
+	return nil
+}
+
+func (c *clientCmd) url(id string) error {
+	u, err := c.client.BackupURL(id)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(&backupURL{URL: u})
+	}
+	fmt.Fprintln(c.out, u)
+	return nil
+}
+
+func (c *clientCmd) download(id string, output string) error {
+	if output == "" {
+		output = id + ".dump"
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	n, err := c.client.Download(id, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	if !c.json {
+		fmt.Fprintf(c.out, "Downloaded %s to %s\n", formatBytes(n), output)
+	}
+	return nil
+}
+
+func (c *clientCmd) cancel(id string) error {
+	if err := c.client.Cancel(id); err != nil {
+		return err
+	}
+	if !c.json {
+		fmt.Fprintln(c.out, "Cancel requested")
+	}
+	return nil
+}
+
+// progress shows the running jobs, redrawing them as each event arrives
+// when following
+func (c *clientCmd) progress(follow bool) error {
+	lines := 0
+	return c.client.Progress(func(jobs []*JobProgress) bool {
+		if c.json {
+			json.NewEncoder(c.out).Encode(jobs)
+			return follow
+		}
+		// back over the last event's lines to draw over them
+		if lines > 0 {
+			fmt.Fprintf(c.out, "\033[%dA", lines)
+		}
+		if len(jobs) == 0 {
+			fmt.Fprint(c.out, "No jobs running\033[K\n")
+		}
+		for _, j := range jobs {
+			fmt.Fprintf(c.out, "%s\033[K\n", progressLine(j))
+		}
+		// clear what's left of a longer previous event
+		for i := len(jobs); i < lines; i++ {
+			fmt.Fprint(c.out, "\033[K\n")
+		}
+		if len(jobs) > lines {
+			lines = len(jobs)
+		}
+		if lines == 0 {
+			lines = 1
+		}
+		return follow
+	})
+}
+
+const progressBarWidth = 30
+
+func progressLine(j *JobProgress) string {
+	name := j.AppName
+	if j.Kind == JobKindSelfBackup {
+		name = "pgbackups"
+	} else if name == "" {
+		name = j.AppID
+	}
+	phase := j.Phase
+	if phase == "" {
+		phase = "starting"
+	}
+	line := fmt.Sprintf("%-20s %-11s %-10s ", name, j.Kind, phase)
+
+	// only a dump or a read of a stored backup can be measured against its
+	// expected size
+	if j.ExpectedBytes > 0 && (phase == PhaseDumping || phase == PhaseRestoring || phase == PhaseVerifying) {
+		ratio := float64(j.ProgressBytes) / float64(j.ExpectedBytes)
+		if ratio > 1 {
+			ratio = 1
+		}
+		filled := int(ratio * progressBarWidth)
+		line += fmt.Sprintf("[%s%s] %3.0f%% ", strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), ratio*100)
+	}
+	line += formatBytes(j.ProgressBytes)
+	if j.BytesPerSecond > 0 {
+		line += fmt.Sprintf(" %s/s", formatBytes(j.BytesPerSecond))
+	}
+	return line
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// formatBytes is n in the largest binary unit it has at least one of
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestLoadClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgbackups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"url": "http://file", "key": "file-key"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("PGBACKUPS_KEY")
+	os.Setenv("PGBACKUPS_URL", "http://env")
+	defer os.Unsetenv("PGBACKUPS_URL")
+
+	for _, test := range []struct {
+		path, url, key string
+		expected       ClientConfig
+	}{
+		{path, "", "", ClientConfig{URL: "http://env", Key: "file-key"}},
+		{path, "http://flag", "flag-key", ClientConfig{URL: "http://flag", Key: "flag-key"}},
+		// a missing file isn't an error
+		{filepath.Join(dir, "missing.json"), "", "", ClientConfig{URL: "http://env"}},
+	} {
+		config, err := LoadClientConfig(test.path, test.url, test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *config != test.expected {
+			t.Errorf("expected %+v, got %+v", test.expected, *config)
+		}
+	}
+
+	os.Unsetenv("PGBACKUPS_URL")
+	if _, err := LoadClientConfig("", "", ""); err != errNoClientURL {
+		t.Errorf("expected errNoClientURL, got %v", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	api, srv := newTestAPI(t, []string{"key"})
+	defer srv.Close()
+	repo := api.PgBackups.Repo
+
+	b, err := repo.NewBackup(random.UUID(), "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(b)
+
+	c := NewClient(srv.URL+"/", "key")
+	got, err := c.Backup(b.BackupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BackupID != b.BackupID || got.Status != BackupStatusRunning {
+		t.Errorf("expected the running backup, got %+v", got)
+	}
+
+	// errors from the API are decoded
+	if _, err := c.BackupURL(b.BackupID); !httphelper.IsPreconditionFailedError(err) {
+		t.Errorf("expected a precondition failed error, got %v", err)
+	}
+	if _, err := c.Backup(random.UUID()); !httphelper.IsObjectNotFoundError(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if _, err := NewClient(srv.URL, "wrong").Backup(b.BackupID); err == nil {
+		t.Error("expected an error with the wrong key")
+	}
+}
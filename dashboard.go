@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	dashboardCookie = "pgbackups_session"
+	// holds the CSRF token of the login form, as there's no session yet
+	loginCookie = "pgbackups_login"
+	// backups shown in each app's size trend
+	sparklineBackups = 20
+)
+
+// csrfToken is put in the dashboard's forms, and checked when they are posted
+func csrfToken(session string) string {
+	mac := hmac.New(sha256.New, []byte(session))
+	mac.Write([]byte("dashboard csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// the dashboard is for browsers, which can't send a bearer token, so logging
+// in with an API key starts a session instead, see CreateSession.  dashboard
+// routes check the session cookie and the API routes don't, so a cookie
+// can't be used to call the API from another site.
+func (a *API) validSession(id string) (bool, error) {
+	keyHash, err := a.PgBackups.Repo.SessionKeyHash(id)
+	if err != nil || keyHash == "" {
+		return false, err
+	}
+	valid := false
+	for _, k := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashToken(k))) == 1 {
+			valid = true
+		}
+	}
+	return valid, nil
+}
+
+func (a *API) dashboardHandler() http.Handler {
+	r := httprouter.New()
+	r.GET("/dashboard/login", a.dashboardLoginForm)
+	r.POST("/dashboard/login", a.dashboardLogin)
+	r.POST("/dashboard/logout", a.dashboardSession(a.dashboardLogout))
+	r.GET("/dashboard", a.dashboardSession(a.dashboardApps))
+	r.GET("/dashboard/apps/:app", a.dashboardSession(a.dashboardApp))
+	r.POST("/dashboard/apps/:app/capture", a.dashboardSession(a.dashboardCapture))
+	r.GET("/dashboard/backups/:id", a.dashboardSession(a.dashboardBackup))
+	r.GET("/dashboard/backups/:id/download", a.dashboardSession(a.dashboardDownload))
+	r.POST("/dashboard/backups/:id/pin", a.dashboardSession(a.dashboardPin(true)))
+	r.POST("/dashboard/backups/:id/unpin", a.dashboardSession(a.dashboardPin(false)))
+	r.POST("/dashboard/backups/:id/restore", a.dashboardSession(a.dashboardRestore))
+	return r
+}
+
+type dashboardPage struct {
+	Title   string
+	CSRF    string
+	Message string
+	Error   string
+	Data    interface{}
+
+	// the status of error pages
+	status int
+}
+
+// notFoundError marks errors about records that don't exist
+type notFoundError struct {
+	error
+}
+
+// errorStatus is the status of an error page, 500 unless err says more
+func errorStatus(err error) int {
+	var nf notFoundError
+	switch {
+	case errors.As(err, &nf), err == controller.ErrNotFound, httphelper.IsObjectNotFoundError(err):
+		return http.StatusNotFound
+	case httphelper.IsPreconditionFailedError(err):
+		return http.StatusPreconditionFailed
+	case httphelper.IsValidationError(err):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// dashboardSession only calls h for requests with a valid session, checking
+// the CSRF token of posted forms
+func (a *API) dashboardSession(h func(http.ResponseWriter, *http.Request, httprouter.Params, *dashboardPage)) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		cookie, err := req.Cookie(dashboardCookie)
+		if err != nil {
+			http.Redirect(w, req, "/dashboard/login", http.StatusSeeOther)
+			return
+		}
+		valid, err := a.validSession(cookie.Value)
+		if err != nil {
+			a.renderError(w, &dashboardPage{}, err)
+			return
+		}
+		if !valid {
+			http.Redirect(w, req, "/dashboard/login", http.StatusSeeOther)
+			return
+		}
+		csrf := csrfToken(cookie.Value)
+		if req.Method == "POST" && subtle.ConstantTimeCompare([]byte(req.PostFormValue("csrf")), []byte(csrf)) != 1 {
+			http.Error(w, "invalid form, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		h(w, req, params, &dashboardPage{CSRF: csrf, Message: req.URL.Query().Get("message")})
+	}
+}
+
+func (a *API) render(w http.ResponseWriter, name string, page *dashboardPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if page.Error != "" {
+		w.WriteHeader(page.status)
+	}
+	if err := dashboardTemplates.ExecuteTemplate(w, name, page); err != nil {
+		logger.Error("Error rendering dashboard", "page", name, "err", err)
+	}
+}
+
+// renderError shows err in place of the page
+func (a *API) renderError(w http.ResponseWriter, page *dashboardPage, err error) {
+	page.Title = "Error"
+	page.Error = err.Error()
+	page.status = errorStatus(err)
+	a.render(w, "error", page)
+}
+
+// redirect goes back to path after an action, with a message to show
+func redirect(w http.ResponseWriter, req *http.Request, path string, message string) {
+	http.Redirect(w, req, path+"?message="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+// secureRequest returns whether req came over https, directly or through the
+// router
+func secureRequest(req *http.Request) bool {
+	return req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// the login form's CSRF token is tied to a cookie set along with it, which
+// another site can't set or read, so it can't log a browser in to a session
+// of its own
+func (a *API) dashboardLoginForm(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	login := random.Hex(32)
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    login,
+		Path:     "/dashboard/login",
+		HttpOnly: true,
+		Secure:   secureRequest(req),
+		SameSite: http.SameSiteStrictMode,
+	})
+	a.render(w, "login", &dashboardPage{Title: "Log in", Data: csrfToken(login)})
+}
+
+func (a *API) dashboardLogin(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	cookie, err := req.Cookie(loginCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(req.PostFormValue("csrf")), []byte(csrfToken(cookie.Value))) != 1 {
+		http.Error(w, "invalid form, reload the page and try again", http.StatusForbidden)
+		return
+	}
+	key := req.PostFormValue("key")
+	if !a.validKey(key) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		dashboardTemplates.ExecuteTemplate(w, "login", &dashboardPage{Title: "Log in", Message: "That key isn't valid", Data: csrfToken(cookie.Value)})
+		return
+	}
+	session, err := a.PgBackups.Repo.CreateSession(key, a.SessionTTL)
+	if err != nil {
+		a.renderError(w, &dashboardPage{}, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    session,
+		Path:     "/dashboard",
+		MaxAge:   int(a.SessionTTL / time.Second),
+		HttpOnly: true,
+		Secure:   secureRequest(req),
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/dashboard/login", MaxAge: -1})
+	http.Redirect(w, req, "/dashboard", http.StatusSeeOther)
+}
+
+func (a *API) dashboardLogout(w http.ResponseWriter, req *http.Request, _ httprouter.Params, page *dashboardPage) {
+	cookie, _ := req.Cookie(dashboardCookie)
+	if err := a.PgBackups.Repo.DeleteSession(cookie.Value); err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: "/dashboard", MaxAge: -1})
+	http.Redirect(w, req, "/dashboard/login", http.StatusSeeOther)
+}
+
+type dashboardApp struct {
+	App       *AppAndRelease
+	Last      *Backup
+	NextRun   time.Time
+	Sparkline string
+	Backups   []*Backup
+}
+
+func (a *API) dashboardApps(w http.ResponseWriter, req *http.Request, _ httprouter.Params, page *dashboardPage) {
+	apps, err := a.PgBackups.AppsToBackUp()
+	if err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	runs := a.nextRuns(apps)
+	rows := make([]*dashboardApp, 0, len(apps))
+	for _, app := range apps {
+		backups, err := a.PgBackups.Repo.GetBackups(app.App.ID)
+		if err != nil {
+			a.renderError(w, page, err)
+			return
+		}
+		row := &dashboardApp{App: app, NextRun: runs[app.App.ID], Sparkline: sparkline(backups, sparklineBackups)}
+		if len(backups) > 0 {
+			row.Last = backups[len(backups)-1]
+		}
+		rows = append(rows, row)
+	}
+	page.Title = "Apps"
+	page.Data = rows
+	a.render(w, "apps", page)
+}
+
+// nextRuns returns when each app is next scheduled, if this process runs the
+// scheduler.  failing to work it out only leaves it off the page.
+func (a *API) nextRuns(apps []*AppAndRelease) map[string]time.Time {
+	if a.Scheduler == nil {
+		return nil
+	}
+	blackouts, err := a.PgBackups.Repo.GetBlackouts()
+	if err != nil {
+		logger.Error("Error getting blackouts", "err", err)
+		return nil
+	}
+	runs, err := a.Scheduler.NextRuns(apps, blackouts, time.Now())
+	if err != nil {
+		logger.Error("Error working out next runs", "err", err)
+		return nil
+	}
+	return runs
+}
+
+func (a *API) dashboardApp(w http.ResponseWriter, req *http.Request, params httprouter.Params, page *dashboardPage) {
+	app, err := a.PgBackups.FlynnClient.GetAppAndRelease(params.ByName("app"))
+	if err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	backups, err := a.PgBackups.Repo.GetBackups(app.App.ID)
+	if err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	runs := a.nextRuns([]*AppAndRelease{app})
+	data := &dashboardApp{App: app, NextRun: runs[app.App.ID], Sparkline: sparkline(backups, sparklineBackups)}
+	// listed newest first
+	for i := len(backups) - 1; i >= 0; i-- {
+		data.Backups = append(data.Backups, backups[i])
+	}
+	page.Title = app.App.Name
+	page.Data = data
+	a.render(w, "app", page)
+}
+
+func (a *API) dashboardCapture(w http.ResponseWriter, req *http.Request, params httprouter.Params, page *dashboardPage) {
+	appName := params.ByName("app")
+	jobs, err := a.PgBackups.EnqueueBackups(TriggerManual, appName)
+	if err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	redirect(w, req, "/dashboard/apps/"+url.PathEscape(appName), "Queued backup job "+jobs[0].JobID)
+}
+
+// dashboardBackupFor looks up the backup in the path, showing an error page
+// and returning nil if it can't be found
+func (a *API) dashboardBackupFor(w http.ResponseWriter, params httprouter.Params, page *dashboardPage) *Backup {
+	id := params.ByName("id")
+	var b *Backup
+	var err error
+	if uuidPattern.MatchString(id) {
+		b, err = a.PgBackups.Repo.GetBackup(id)
+	}
+	if err == nil && b == nil {
+		err = notFoundError{fmt.Errorf("backup %s not found", id)}
+	}
+	if err != nil {
+		a.renderError(w, page, err)
+		return nil
+	}
+	return b
+}
+
+func (a *API) dashboardBackup(w http.ResponseWriter, req *http.Request, params httprouter.Params, page *dashboardPage) {
+	b := a.dashboardBackupFor(w, params, page)
+	if b == nil {
+		return
+	}
+	if err := a.PgBackups.Repo.LoadBackupLogs(b); err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	page.Title = "Backup " + b.BackupID
+	page.Data = b
+	a.render(w, "backup", page)
+}
+
+func (a *API) dashboardDownload(w http.ResponseWriter, req *http.Request, params httprouter.Params, page *dashboardPage) {
+	b := a.dashboardBackupFor(w, params, page)
+	if b == nil {
+		return
+	}
+	stored, err := a.PgBackups.StoredBackupFor(b)
+	if err == nil && stored.Status != BackupStatusCompleted {
+		err = errNotCompleted(stored)
+	}
+	var u string
+	if err == nil {
+		u, err = a.PgBackups.Store.DownloadUrl(stored.AppID, stored.BackupID)
+	}
+	if err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	http.Redirect(w, req, u, http.StatusSeeOther)
+}
+
+func (a *API) dashboardPin(pinned bool) func(http.ResponseWriter, *http.Request, httprouter.Params, *dashboardPage) {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params, page *dashboardPage) {
+		b := a.dashboardBackupFor(w, params, page)
+		if b == nil {
+			return
+		}
+		if err := a.PgBackups.Repo.SetPinned(b, pinned); err != nil {
+			a.renderError(w, page, err)
+			return
+		}
+		message := "Unpinned backup"
+		if pinned {
+			message = "Pinned backup"
+		}
+		redirect(w, req, "/dashboard/backups/"+b.BackupID, message)
+	}
+}
+
+func (a *API) dashboardRestore(w http.ResponseWriter, req *http.Request, params httprouter.Params, page *dashboardPage) {
+	b := a.dashboardBackupFor(w, params, page)
+	if b == nil {
+		return
+	}
+	j, err := a.PgBackups.EnqueueRestore(b, strings.TrimSpace(req.PostFormValue("app")))
+	if err != nil {
+		a.renderError(w, page, err)
+		return
+	}
+	redirect(w, req, "/dashboard/backups/"+b.BackupID, "Queued restore job "+j.JobID)
+}
+
+// sparkline returns the points of a polyline of the sizes of the last n
+// completed backups, scaled to a 100x20 box.  backups are oldest first.
+func sparkline(backups []*Backup, n int) string {
+	sizes := []int64{}
+	for _, b := range backups {
+		if b.Status == BackupStatusCompleted {
+			sizes = append(sizes, b.Bytes)
+		}
+	}
+	if len(sizes) > n {
+		sizes = sizes[len(sizes)-n:]
+	}
+	if len(sizes) < 2 {
+		return ""
+	}
+
+	var max int64
+	for _, s := range sizes {
+		if s > max {
+			max = s
+		}
+	}
+	points := make([]string, len(sizes))
+	for i, s := range sizes {
+		x := float64(i) * 100 / float64(len(sizes)-1)
+		y := 20.0
+		if max > 0 {
+			y = 20 - float64(s)*20/float64(max)
+		}
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	return strings.Join(points, " ")
+}
+
+var dashboardTemplates = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"time":  formatTime,
+	"nextRun": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return formatTime(&t)
+	},
+	"pathEscape": url.PathEscape,
+}).Parse(dashboardHTML))
+
+const dashboardHTML = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - pgbackups</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; }
+.completed { color: #2a7a2a; } .unchanged { color: #2a7a2a; } .failed { color: #b22; } .running { color: #a70; } .cancelled { color: #777; }
+.message { background: #eef6ee; padding: 0.5em; } .error { background: #fbeaea; padding: 0.5em; }
+form.inline { display: inline; }
+svg polyline { fill: none; stroke: #36c; stroke-width: 1.5; }
+</style>
+</head>
+<body>
+{{if .CSRF}}<form class="inline" method="post" action="/dashboard/logout"><input type="hidden" name="csrf" value="{{.CSRF}}"><a href="/dashboard">Apps</a> <button>Log out</button></form>{{end}}
+<h1>{{.Title}}</h1>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "sparkline"}}{{if .}}<svg width="100" height="22" viewBox="0 -1 100 22"><polyline points="{{.}}"/></svg>{{else}}-{{end}}{{end}}
+
+{{define "login"}}{{template "header" .}}
+<form method="post" action="/dashboard/login">
+<input type="hidden" name="csrf" value="{{.Data}}">
+<label>API key <input type="password" name="key" autofocus></label>
+<button>Log in</button>
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "error"}}{{template "header" .}}
+<p class="error">{{.Error}}</p>
+{{template "footer" .}}{{end}}
+
+{{define "apps"}}{{template "header" .}}
+<table>
+<tr><th>App</th><th>Last backup</th><th>Status</th><th>Size</th><th>Trend</th><th>Next run</th><th></th></tr>
+{{range .Data}}<tr>
+<td><a href="/dashboard/apps/{{pathEscape .App.App.Name}}">{{.App.App.Name}}</a></td>
+{{with .Last}}<td><a href="/dashboard/backups/{{.BackupID}}">{{time .StartedAt}}</a></td><td class="{{.Status}}">{{.Status}}</td><td>{{bytes .Bytes}}</td>
+{{else}}<td>-</td><td>-</td><td>-</td>{{end}}
+<td>{{template "sparkline" .Sparkline}}</td>
+<td>{{nextRun .NextRun}}</td>
+<td><form class="inline" method="post" action="/dashboard/apps/{{pathEscape .App.App.Name}}/capture"><input type="hidden" name="csrf" value="{{$.CSRF}}"><button>Capture now</button></form></td>
+</tr>{{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "app"}}{{template "header" .}}
+{{with .Data}}<p>Next run: {{nextRun .NextRun}} &middot; Trend: {{template "sparkline" .Sparkline}}</p>{{end}}
+<form method="post" action="/dashboard/apps/{{pathEscape .Data.App.App.Name}}/capture"><input type="hidden" name="csrf" value="{{.CSRF}}"><button>Capture now</button></form>
+<table>
+<tr><th>Started</th><th>Completed</th><th>Size</th><th>Status</th><th>Trigger</th><th>Pinned</th></tr>
+{{range .Data.Backups}}<tr>
+<td><a href="/dashboard/backups/{{.BackupID}}">{{time .StartedAt}}</a></td><td>{{time .CompletedAt}}</td><td>{{bytes .Bytes}}</td>
+<td class="{{.Status}}">{{.Status}}</td><td>{{.Trigger}}</td><td>{{if .Pinned}}pinned{{end}}</td>
+</tr>{{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "backup"}}{{template "header" .}}
+{{with .Data}}<table>
+<tr><th>App</th><td><a href="/dashboard/apps/{{pathEscape .AppName}}">{{.AppName}}</a> ({{.AppID}})</td></tr>
+<tr><th>Status</th><td class="{{.Status}}">{{.Status}}</td></tr>
+<tr><th>Trigger</th><td>{{.Trigger}}</td></tr>
+<tr><th>Started</th><td>{{time .StartedAt}}</td></tr>
+<tr><th>Completed</th><td>{{time .CompletedAt}}</td></tr>
+<tr><th>Size</th><td>{{bytes .Bytes}}</td></tr>
+<tr><th>Checksum</th><td>{{.Checksum}}</td></tr>
+<tr><th>Attempts</th><td>{{.Attempts}}</td></tr>
+{{if .ReleaseID}}<tr><th>Release</th><td>{{.ReleaseID}}</td></tr>{{end}}
+{{if .DeployReleaseID}}<tr><th>Before deploying</th><td>{{.DeployReleaseID}}</td></tr>{{end}}
+{{if .SameAs}}<tr><th>Same as</th><td><a href="/dashboard/backups/{{.SameAs}}">{{.SameAs}}</a></td></tr>{{end}}
+{{if .VerifiedAt}}<tr><th>Verified</th><td>{{time .VerifiedAt}} {{if .VerifyError}}<span class="failed">{{.VerifyError}}</span>{{else}}<span class="completed">ok</span>{{end}}</td></tr>{{end}}
+{{if .Error}}<tr><th>Error</th><td class="failed">{{.Error}}</td></tr>{{end}}
+<tr><th>Pinned</th><td>{{.Pinned}}</td></tr>
+</table>{{end}}
+<p>
+{{if or (eq .Data.Status "completed") (eq .Data.Status "unchanged")}}<a href="/dashboard/backups/{{.Data.BackupID}}/download">Download</a>{{end}}
+{{if .Data.Pinned}}<form class="inline" method="post" action="/dashboard/backups/{{.Data.BackupID}}/unpin"><input type="hidden" name="csrf" value="{{.CSRF}}"><button>Unpin</button></form>
+{{else}}<form class="inline" method="post" action="/dashboard/backups/{{.Data.BackupID}}/pin"><input type="hidden" name="csrf" value="{{.CSRF}}"><button>Pin</button></form>{{end}}
+</p>
+{{if or (eq .Data.Status "completed") (eq .Data.Status "unchanged")}}
+<form method="post" action="/dashboard/backups/{{.Data.BackupID}}/restore" onsubmit="return confirm('This replaces the data in the database of the app. Restore?')">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>Restore into app <input name="app" placeholder="{{.Data.AppName}}"></label>
+<button>Restore</button>
+</form>
+{{end}}
+{{if .Data.Log}}<h2>Log</h2>
+<pre>{{.Data.Log}}</pre>{{end}}
+{{template "footer" .}}{{end}}
+`
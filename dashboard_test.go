@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestSparkline(t *testing.T) {
+	backups := []*Backup{
+		{Status: BackupStatusCompleted, Bytes: 50},
+		{Status: BackupStatusFailed},
+		{Status: BackupStatusCompleted, Bytes: 100},
+		{Status: BackupStatusCompleted, Bytes: 0},
+	}
+	if points := sparkline(backups, 20); points != "0.0,10.0 50.0,0.0 100.0,20.0" {
+		t.Errorf("unexpected points %q", points)
+	}
+	// only the last n are drawn, and one isn't a line
+	if points := sparkline(backups, 2); points != "0.0,0.0 100.0,20.0" {
+		t.Errorf("unexpected points %q", points)
+	}
+	if points := sparkline(backups[:1], 20); points != "" {
+		t.Errorf("expected no points, got %q", points)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	api, srv := newTestAPI(t, []string{"key"})
+	defer srv.Close()
+	repo := api.PgBackups.Repo
+
+	b, err := repo.NewBackup(random.UUID(), "test", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(b)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	backupPath := srv.URL + "/dashboard/backups/" + b.BackupID
+
+	// pages need a session
+	res, err := client.Get(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/dashboard/login" {
+		t.Errorf("expected a redirect to log in, got %d %s", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	// logging in needs the cookie set with the login form
+	res, err = client.Get(srv.URL + "/dashboard/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(res.Cookies()) != 1 || res.Cookies()[0].Name != loginCookie {
+		t.Fatalf("expected a login cookie, got %v", res.Cookies())
+	}
+	loginForm := res.Cookies()[0]
+	login := func(key string, cookie *http.Cookie) *http.Response {
+		form := url.Values{"key": {key}, "csrf": {csrfToken(loginForm.Value)}}
+		req, _ := http.NewRequest("POST", srv.URL+"/dashboard/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	if res := login("key", nil); res.StatusCode != http.StatusForbidden || len(res.Cookies()) != 0 {
+		t.Errorf("expected a login without the form's cookie to be refused, got %d", res.StatusCode)
+	}
+	if res := login("key", &http.Cookie{Name: loginCookie, Value: "other"}); res.StatusCode != http.StatusForbidden || len(res.Cookies()) != 0 {
+		t.Errorf("expected a login with another form's token to be refused, got %d", res.StatusCode)
+	}
+	if res := login("wrong", loginForm); res.StatusCode != http.StatusUnauthorized || len(res.Cookies()) != 0 {
+		t.Errorf("expected the wrong key to be refused, got %d", res.StatusCode)
+	}
+	res = login("key", loginForm)
+	var session *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == dashboardCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatalf("expected a session cookie, got %v", res.Cookies())
+	}
+
+	do := func(method, path string, form url.Values) (*http.Response, string) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(session)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res, body := do("GET", backupPath, nil)
+	if res.StatusCode != 200 || !strings.Contains(body, b.BackupID) {
+		t.Errorf("expected the backup page, got %d:\n%s", res.StatusCode, body)
+	}
+
+	// forms are refused without the page's token
+	if res, _ := do("POST", backupPath+"/pin", url.Values{}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 without a csrf token, got %d", res.StatusCode)
+	}
+	res, _ = do("POST", backupPath+"/pin", url.Values{"csrf": {csrfToken(session.Value)}})
+	if res.StatusCode != http.StatusSeeOther {
+		t.Errorf("expected a redirect after pinning, got %d", res.StatusCode)
+	}
+	if pinned, _ := repo.GetBackup(b.BackupID); pinned == nil || !pinned.Pinned {
+		t.Error("expected the backup to be pinned")
+	}
+
+	// the session isn't an API key
+	req, _ := http.NewRequest("GET", srv.URL+"/backups/"+b.BackupID, nil)
+	req.AddCookie(session)
+	req.Header.Set("Authorization", "Bearer "+session.Value)
+	if res, err := client.Do(req); err != nil || res.StatusCode != 401 {
+		t.Errorf("expected the API to refuse the session, got %v %v", res, err)
+	}
+
+	// missing records are not found rather than errors
+	if res, _ := do("GET", srv.URL+"/dashboard/backups/"+random.UUID(), nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing backup, got %d", res.StatusCode)
+	}
+
+	// logging out needs the page's token too
+	do("POST", srv.URL+"/dashboard/logout", nil)
+	if res, _ := do("GET", backupPath, nil); res.StatusCode != 200 {
+		t.Errorf("expected the session to survive a logout without a token, got %d", res.StatusCode)
+	}
+
+	// sessions can't be used after logging out
+	do("POST", srv.URL+"/dashboard/logout", url.Values{"csrf": {csrfToken(session.Value)}})
+	if res, _ := do("GET", backupPath, nil); res.StatusCode != http.StatusSeeOther {
+		t.Errorf("expected a redirect to log in after logging out, got %d", res.StatusCode)
+	}
+
+	// or once they expire
+	expired, err := repo.CreateSession("key", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session = &http.Cookie{Name: dashboardCookie, Value: expired}
+	if res, _ := do("GET", backupPath, nil); res.StatusCode != http.StatusSeeOther {
+		t.Errorf("expected a redirect to log in with an expired session, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+const (
+	defaultDeployRetain = 10
+	// the status of a deployment's first event
+	deploymentPending = "pending"
+)
+
+// watchDeploys queues a backup of an app as soon as a deployment of it
+// starts, while this worker is the leader, until ctx is done.  Deployments
+// started while no worker is leading are missed.
+func (s *Scheduler) watchDeploys(ctx context.Context) {
+	for {
+		if s.leader.Held() {
+			if err := s.streamDeploys(ctx); err != nil {
+				logger.Error("Error streaming deployment events", "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// streamDeploys handles deployment events until the stream fails, ctx is
+// done or this worker stops being the leader
+func (s *Scheduler) streamDeploys(ctx context.Context) error {
+	events := make(chan *ct.Event)
+	stream, err := s.PgBackups.FlynnClient.StreamDeploymentEvents(events)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if !s.leader.Held() {
+				return nil
+			}
+		case e, ok := <-events:
+			if !ok {
+				return stream.Err()
+			}
+			j, err := s.PgBackups.EnqueueDeployBackup(e)
+			if err != nil {
+				logger.Error("Error queueing deploy backup", "app_id", e.AppID, "err", err)
+			} else if j != nil {
+				j.logger().Info("Queued deploy backup", "release_id", j.ReleaseID)
+			}
+		}
+	}
+}
+
+// EnqueueDeployBackup queues a backup of the app if the event is the start
+// of a deployment and the app is backed up, returning nil otherwise
+func (pgb *PgBackups) EnqueueDeployBackup(e *ct.Event) (*Job, error) {
+	var d ct.DeploymentEvent
+	if err := json.Unmarshal(e.Data, &d); err != nil {
+		return nil, err
+	}
+	if d.Status != deploymentPending {
+		return nil, nil
+	}
+
+	appID := d.AppID
+	if appID == "" {
+		appID = e.AppID
+	}
+	app, err := pgb.FlynnClient.GetAppAndRelease(appID)
+	if err != nil {
+		return nil, err
+	}
+	if !backsUp(app) {
+		return nil, nil
+	}
+
+	j := newAppJob(JobKindBackup, app, TriggerDeploy)
+	j.ReleaseID = d.ReleaseID
+	return j, pgb.Repo.EnqueueJob(j)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestEnqueueDeployBackup(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups_jobs"); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("APPS")
+
+	withPostgres := &AppAndRelease{
+		App:     &ct.App{ID: random.UUID(), Name: "with-postgres"},
+		Release: &ct.Release{Env: map[string]string{"FLYNN_POSTGRES": "postgres", "PGHOST": "leader.postgres.discoverd"}},
+	}
+	withoutPostgres := &AppAndRelease{
+		App:     &ct.App{ID: random.UUID(), Name: "without-postgres"},
+		Release: &ct.Release{Env: map[string]string{}},
+	}
+	pgb := &PgBackups{Repo: repo, FlynnClient: &FlynnClient{client: newFakeController(withPostgres, withoutPostgres)}}
+
+	event := func(eventAppID string, d ct.DeploymentEvent) *ct.Event {
+		data, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ct.Event{AppID: eventAppID, ObjectType: ct.EventTypeDeployment, Data: data}
+	}
+	releaseID := random.UUID()
+
+	for _, test := range []struct {
+		name   string
+		event  *ct.Event
+		queued bool
+	}{
+		{"pending", event("", ct.DeploymentEvent{AppID: withPostgres.App.ID, ReleaseID: releaseID, Status: deploymentPending}), true},
+		// the event's app is used when the deployment doesn't name one
+		{"app fallback", event(withPostgres.App.ID, ct.DeploymentEvent{ReleaseID: releaseID, Status: deploymentPending}), true},
+		{"later status", event("", ct.DeploymentEvent{AppID: withPostgres.App.ID, ReleaseID: releaseID, Status: "complete"}), false},
+		{"no postgres", event("", ct.DeploymentEvent{AppID: withoutPostgres.App.ID, ReleaseID: releaseID, Status: deploymentPending}), false},
+	} {
+		j, err := pgb.EnqueueDeployBackup(test.event)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !test.queued {
+			if j != nil {
+				t.Errorf("%s: expected nothing to be queued, got %+v", test.name, j)
+			}
+			continue
+		}
+		if j == nil || j.AppID != withPostgres.App.ID || j.Trigger != TriggerDeploy || j.ReleaseID != releaseID || j.PgCluster != "postgres" {
+			t.Errorf("%s: expected a deploy backup of %s, got %+v", test.name, withPostgres.App.Name, j)
+		}
+	}
+
+	// apps left out by APPS aren't backed up as they deploy either
+	os.Setenv("APPS", "another-app")
+	defer os.Unsetenv("APPS")
+	if j, err := pgb.EnqueueDeployBackup(event("", ct.DeploymentEvent{AppID: withPostgres.App.ID, Status: deploymentPending})); err != nil || j != nil {
+		t.Errorf("expected nothing to be queued for an app not in APPS, got %+v %v", j, err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var errNoMailer = errors.New("SMTP_HOST must be set to send the digest")
+
+// Digest summarises the backups of every app, to be emailed on the digest
+// schedule
+type Digest struct {
+	Time time.Time
+	Rows []*DigestRow
+}
+
+type DigestRow struct {
+	AppID   string
+	AppName string
+	// the app's most recent backup that finished, whether it succeeded or
+	// not, and its most recent that completed
+	Last          *Backup
+	LastCompleted *Backup
+	// the size of LastCompleted relative to the completed backup before it,
+	// if there was one
+	SizeChange    float64
+	HasSizeChange bool
+	// the completed backups kept in the store
+	Retained int
+}
+
+// Status is the status of the last backup, or "none" if there hasn't been one
+func (r *DigestRow) Status() string {
+	if r.Last == nil {
+		return "none"
+	}
+	return r.Last.Status
+}
+
+// Digest builds the digest of the apps being backed up
+func (pgb *PgBackups) Digest(now time.Time) (*Digest, error) {
+	apps, err := pgb.AppsToBackUp()
+	if err != nil {
+		return nil, err
+	}
+	backups, err := pgb.Repo.GetAllBackups()
+	if err != nil {
+		return nil, err
+	}
+	return buildDigest(apps, backups, now), nil
+}
+
+// buildDigest expects each app's backups oldest first, as GetAllBackups
+// returns them
+func buildDigest(apps []*AppAndRelease, backups []*Backup, now time.Time) *Digest {
+	rows := make(map[string]*DigestRow, len(apps))
+	d := &Digest{Time: now}
+	for _, a := range apps {
+		r := &DigestRow{AppID: a.App.ID, AppName: a.App.Name}
+		rows[a.App.ID] = r
+		d.Rows = append(d.Rows, r)
+	}
+
+	for _, b := range backups {
+		r, ok := rows[b.AppID]
+		if !ok {
+			continue
+		}
+		switch b.Status {
+		case BackupStatusCompleted:
+			if r.LastCompleted != nil && r.LastCompleted.Bytes > 0 {
+				r.SizeChange = float64(b.Bytes-r.LastCompleted.Bytes) / float64(r.LastCompleted.Bytes)
+				r.HasSizeChange = true
+			}
+			r.LastCompleted = b
+			r.Retained++
+			r.Last = b
+		case BackupStatusUnchanged, BackupStatusFailed:
+			r.Last = b
+		}
+	}
+
+	sort.Slice(d.Rows, func(i, j int) bool { return d.Rows[i].AppName < d.Rows[j].AppName })
+	return d
+}
+
+// Failing is the number of apps whose last backup failed
+func (d *Digest) Failing() int {
+	n := 0
+	for _, r := range d.Rows {
+		if r.Status() == BackupStatusFailed {
+			n++
+		}
+	}
+	return n
+}
+
+func formatSizeChange(r *DigestRow) string {
+	if !r.HasSizeChange {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", r.SizeChange*100)
+}
+
+func (d *Digest) Subject() string {
+	return fmt.Sprintf("[pgbackups] Backup digest: %d apps, %d failing", len(d.Rows), d.Failing())
+}
+
+// Text is the digest as a table, for the plain text part of the email and
+// the digest command
+func (d *Digest) Text() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Backups as of %s\n\n", d.Time.UTC().Format(time.RFC1123))
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "APP\tLAST BACKUP\tSTATUS\tLAST COMPLETED\tSIZE\tCHANGE\tRETAINED")
+	for _, r := range d.Rows {
+		last, completed, size := "-", "-", "-"
+		if r.Last != nil {
+			last = r.Last.StartedAt.UTC().Format("2006-01-02 15:04")
+		}
+		if r.LastCompleted != nil {
+			completed = r.LastCompleted.StartedAt.UTC().Format("2006-01-02 15:04")
+			size = formatBytes(r.LastCompleted.Bytes)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", r.AppName, last, r.Status(), completed, size, formatSizeChange(r), r.Retained)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func (d *Digest) HTML() (string, error) {
+	var buf strings.Builder
+	err := digestTemplate.Execute(&buf, d)
+	return buf.String(), err
+}
+
+// SendDigest emails the digest to the mailer's recipients
+func (pgb *PgBackups) SendDigest(ctx context.Context, now time.Time) error {
+	if pgb.Mailer == nil {
+		return errNoMailer
+	}
+	d, err := pgb.Digest(now)
+	if err != nil {
+		return err
+	}
+	html, err := d.HTML()
+	if err != nil {
+		return err
+	}
+	email := &Email{Subject: d.Subject(), Text: d.Text(), HTML: html}
+	return retryNotify(ctx, notifyRetry, func() error {
+		return pgb.Mailer.Send(ctx, email)
+	})
+}
+
+// mail clients ignore most stylesheets, so styles are inline
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"bytes":  formatBytes,
+	"change": formatSizeChange,
+	"time": func(b *Backup) string {
+		if b == nil {
+			return "-"
+		}
+		return b.StartedAt.UTC().Format("2006-01-02 15:04")
+	},
+	"statusColor": func(status string) string {
+		switch status {
+		case BackupStatusCompleted, BackupStatusUnchanged:
+			return "#2a7a2a"
+		case BackupStatusFailed:
+			return "#b22"
+		}
+		return "#777"
+	},
+}).Parse(`<p style="font-family: sans-serif">Backups as of {{.Time.UTC.Format "Mon, 02 Jan 2006 15:04 MST"}}</p>
+<table style="font-family: sans-serif; border-collapse: collapse">
+<tr>
+<th style="text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd">App</th>
+<th style="text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd">Last backup</th>
+<th style="text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd">Status</th>
+<th style="text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd">Last completed</th>
+<th style="text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd">Size</th>
+<th style="text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd">Change</th>
+<th style="text-align: left; padding: 4px 10px; border-bottom: 1px solid #ddd">Retained</th>
+</tr>
+{{range .Rows}}<tr>
+<td style="padding: 4px 10px">{{.AppName}}</td>
+<td style="padding: 4px 10px">{{time .Last}}</td>
+<td style="padding: 4px 10px; color: {{statusColor .Status}}">{{.Status}}</td>
+<td style="padding: 4px 10px">{{time .LastCompleted}}</td>
+<td style="padding: 4px 10px">{{with .LastCompleted}}{{bytes .Bytes}}{{else}}-{{end}}</td>
+<td style="padding: 4px 10px">{{change .}}</td>
+<td style="padding: 4px 10px">{{.Retained}}</td>
+</tr>
+{{end}}</table>
+`))
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func TestBuildDigest(t *testing.T) {
+	now := time.Now()
+	at := func(days int) *time.Time {
+		t := now.Add(time.Duration(-days) * 24 * time.Hour)
+		return &t
+	}
+	apps := []*AppAndRelease{
+		{App: &ct.App{ID: "b", Name: "web"}},
+		{App: &ct.App{ID: "a", Name: "api"}},
+		{App: &ct.App{ID: "c", Name: "new"}},
+	}
+	backups := []*Backup{
+		{AppID: "a", StartedAt: at(3), Status: BackupStatusCompleted, Bytes: 100},
+		{AppID: "a", StartedAt: at(2), Status: BackupStatusCompleted, Bytes: 150},
+		{AppID: "a", StartedAt: at(1), Status: BackupStatusFailed},
+		{AppID: "a", StartedAt: at(0), Status: BackupStatusRunning},
+		{AppID: "b", StartedAt: at(1), Status: BackupStatusCompleted, Bytes: 100},
+		{AppID: "b", StartedAt: at(0), Status: BackupStatusUnchanged},
+		{AppID: "gone", StartedAt: at(0), Status: BackupStatusCompleted},
+	}
+
+	d := buildDigest(apps, backups, now)
+	if len(d.Rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(d.Rows))
+	}
+	api, newApp, web := d.Rows[0], d.Rows[1], d.Rows[2]
+	if api.AppName != "api" || newApp.AppName != "new" || web.AppName != "web" {
+		t.Fatalf("expected rows sorted by name, got %s, %s, %s", api.AppName, newApp.AppName, web.AppName)
+	}
+	if api.Status() != BackupStatusFailed || api.LastCompleted != backups[1] || api.Retained != 2 || !api.HasSizeChange || api.SizeChange != 0.5 {
+		t.Errorf("unexpected row for api: %+v", api)
+	}
+	if web.Status() != BackupStatusUnchanged || web.Retained != 1 || web.HasSizeChange {
+		t.Errorf("unexpected row for web: %+v", web)
+	}
+	if newApp.Status() != "none" || newApp.Retained != 0 {
+		t.Errorf("unexpected row for new: %+v", newApp)
+	}
+	if d.Failing() != 1 || d.Subject() != "[pgbackups] Backup digest: 3 apps, 1 failing" {
+		t.Errorf("unexpected subject %q", d.Subject())
+	}
+
+	text := d.Text()
+	if !strings.Contains(text, "+50.0%") || !strings.Contains(text, "150 B") {
+		t.Errorf("unexpected text:\n%s", text)
+	}
+	html, err := d.HTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(html, "<td style=\"padding: 4px 10px; color: #b22\">failed</td>") {
+		t.Errorf("unexpected html:\n%s", html)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// the most of a dump's start, and of pg_dump's stderr, that is kept.  the
+// header is well within this, as its strings are only a database name and
+// two versions.
+const (
+	dumpHeaderBytes = 4 << 10
+	maxStderrBytes  = 16 << 10
+)
+
+var errNotCustomDump = errors.New("not a pg_dump custom format archive")
+
+// DumpHeader is what the header of a custom format archive says about the
+// dump
+type DumpHeader struct {
+	// the version of the archive format, e.g. 1.14.0
+	ArchiveVersion string
+	Compression    string
+	Database       string
+	ServerVersion  string
+	PgDumpVersion  string
+}
+
+// archive format versions, as in pg_backup_archiver.h
+func archiveVersion(major, minor, rev byte) int {
+	return int(major)<<16 | int(minor)<<8 | int(rev)
+}
+
+var (
+	archiveVersion1_4  = archiveVersion(1, 4, 0)
+	archiveVersion1_10 = archiveVersion(1, 10, 0)
+	// postgres 16 records the compression algorithm rather than a gzip level
+	archiveVersion1_15 = archiveVersion(1, 15, 0)
+)
+
+var compressionAlgorithms = []string{"none", "gzip", "lz4", "zstd"}
+
+// ParseDumpHeader reads the header at the start of a custom format archive
+func ParseDumpHeader(data []byte) (*DumpHeader, error) {
+	r := &headerReader{r: bytes.NewReader(data)}
+	magic := r.readBytes(5)
+	if r.err != nil || string(magic) != "PGDMP" {
+		return nil, errNotCustomDump
+	}
+	v := r.readBytes(3)
+	if r.err != nil {
+		return nil, r.err
+	}
+	h := &DumpHeader{ArchiveVersion: fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])}
+	version := archiveVersion(v[0], v[1], v[2])
+	if version < archiveVersion1_4 {
+		return nil, fmt.Errorf("archive version %s is too old", h.ArchiveVersion)
+	}
+
+	r.intSize = int(r.readByte())
+	if r.err == nil && (r.intSize < 1 || r.intSize > 8) {
+		return nil, fmt.Errorf("unexpected int size %d in dump header", r.intSize)
+	}
+	r.readByte() // offset size
+	if format := r.readByte(); r.err == nil && format != 1 {
+		return nil, errNotCustomDump
+	}
+
+	if version >= archiveVersion1_15 {
+		algorithm := int(r.readByte())
+		h.Compression = fmt.Sprintf("unknown (%d)", algorithm)
+		if algorithm < len(compressionAlgorithms) {
+			h.Compression = compressionAlgorithms[algorithm]
+		}
+	} else {
+		switch level := r.readInt(); {
+		case level == -1:
+			h.Compression = "gzip (default level)"
+		case level == 0:
+			h.Compression = "none"
+		default:
+			h.Compression = fmt.Sprintf("gzip level %d", level)
+		}
+	}
+
+	// when the dump was started, as the fields of a struct tm
+	for i := 0; i < 7; i++ {
+		r.readInt()
+	}
+	h.Database = r.readStr()
+	if version >= archiveVersion1_10 {
+		h.ServerVersion = r.readStr()
+		h.PgDumpVersion = r.readStr()
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("error reading dump header: %s", r.err)
+	}
+	return h, nil
+}
+
+// headerReader reads the archive's encodings, keeping the first error
+type headerReader struct {
+	r       *bytes.Reader
+	intSize int
+	err     error
+}
+
+func (r *headerReader) readBytes(n int) []byte {
+	b := make([]byte, n)
+	if r.err == nil {
+		_, r.err = io.ReadFull(r.r, b)
+	}
+	return b
+}
+
+func (r *headerReader) readByte() byte {
+	return r.readBytes(1)[0]
+}
+
+// readInt reads a sign byte then intSize bytes, least significant first
+func (r *headerReader) readInt() int {
+	negative := r.readByte() != 0
+	n := 0
+	for i, b := range r.readBytes(r.intSize) {
+		n |= int(b) << (8 * uint(i))
+	}
+	if negative {
+		return -n
+	}
+	return n
+}
+
+// readStr reads a length, with -1 for null, then that many bytes
+func (r *headerReader) readStr() string {
+	n := r.readInt()
+	if n < 0 || r.err != nil {
+		return ""
+	}
+	if n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	return string(r.readBytes(n))
+}
+
+// cappedBuffer keeps the first max bytes written to it, discarding the rest
+// without failing the write
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// contents returns what was kept, and whether anything was discarded
+func (b *cappedBuffer) contents() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes(), b.truncated
+}
+
+// dumpDetails collects what is learned about a dump as it is streamed: the
+// start of the archive, for its header, and what pg_dump wrote to stderr
+type dumpDetails struct {
+	head   cappedBuffer
+	stderr cappedBuffer
+}
+
+func newDumpDetails() *dumpDetails {
+	return &dumpDetails{head: cappedBuffer{max: dumpHeaderBytes}, stderr: cappedBuffer{max: maxStderrBytes}}
+}
+
+// Header parses the start of the archive
+func (d *dumpDetails) Header() (*DumpHeader, error) {
+	head, _ := d.head.contents()
+	return ParseDumpHeader(head)
+}
+
+func (d *dumpDetails) Stderr() string {
+	stderr, truncated := d.stderr.contents()
+	s := string(stderr)
+	if truncated {
+		s += "\n... stderr truncated\n"
+	}
+	return s
+}
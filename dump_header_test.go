@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// dumpHeader builds the header pg_dump writes for archive version 1.minor,
+// with 4 byte ints
+func dumpHeader(minor byte, compression int) []byte {
+	var buf bytes.Buffer
+	writeInt := func(n int) {
+		sign := byte(0)
+		if n < 0 {
+			sign, n = 1, -n
+		}
+		buf.Write([]byte{sign, byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)})
+	}
+	writeStr := func(s string) {
+		writeInt(len(s))
+		buf.WriteString(s)
+	}
+
+	buf.WriteString("PGDMP")
+	buf.Write([]byte{1, minor, 0, 4, 8, 1})
+	if minor >= 15 {
+		buf.WriteByte(byte(compression))
+	} else {
+		writeInt(compression)
+	}
+	for _, n := range []int{0, 30, 12, 19, 9, 126, 0} {
+		writeInt(n)
+	}
+	writeStr("app_db")
+	writeStr("15.4")
+	writeStr("16.1")
+	// the table of contents follows
+	buf.WriteString("...")
+	return buf.Bytes()
+}
+
+func TestParseDumpHeader(t *testing.T) {
+	for _, test := range []struct {
+		data        []byte
+		compression string
+	}{
+		{dumpHeader(14, -1), "gzip (default level)"},
+		{dumpHeader(14, 0), "none"},
+		{dumpHeader(14, 6), "gzip level 6"},
+		{dumpHeader(15, 3), "zstd"},
+		{dumpHeader(15, 9), "unknown (9)"},
+	} {
+		h, err := ParseDumpHeader(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Compression != test.compression || h.Database != "app_db" || h.ServerVersion != "15.4" || h.PgDumpVersion != "16.1" {
+			t.Errorf("expected %s compression of app_db from 15.4 by 16.1, got %+v", test.compression, h)
+		}
+	}
+
+	if _, err := ParseDumpHeader([]byte("--\n-- PostgreSQL database dump\n")); err != errNotCustomDump {
+		t.Errorf("expected errNotCustomDump for a plain dump, got %v", err)
+	}
+	// cut off in the middle of the database name
+	if _, err := ParseDumpHeader(dumpHeader(14, 0)[:60]); err == nil {
+		t.Error("expected an error for a truncated header")
+	}
+}
+
+func TestDumpDetails(t *testing.T) {
+	d := newDumpDetails()
+	d.head.Write(dumpHeader(15, 1))
+	d.head.Write(make([]byte, dumpHeaderBytes))
+	if h, err := d.Header(); err != nil || h.Compression != "gzip" {
+		t.Errorf("expected a gzip header, got %+v, %v", h, err)
+	}
+
+	d.stderr.Write([]byte("pg_dump: warning: "))
+	if n, err := d.stderr.Write([]byte(strings.Repeat("x", maxStderrBytes))); n != maxStderrBytes || err != nil {
+		t.Errorf("expected writes past the cap to succeed, got %d, %v", n, err)
+	}
+	stderr := d.Stderr()
+	if !strings.HasPrefix(stderr, "pg_dump: warning: x") || !strings.HasSuffix(stderr, "... stderr truncated\n") {
+		t.Errorf("expected truncated stderr, got %q...", stderr[:40])
+	}
+	if len(stderr) > maxStderrBytes+len("\n... stderr truncated\n") {
+		t.Errorf("expected stderr capped at %d bytes, got %d", maxStderrBytes, len(stderr))
+	}
+}
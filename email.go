@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSMTPPort = "587"
+	// the port of servers that speak TLS from the start, rather than
+	// upgrading with STARTTLS
+	smtpsPort   = "465"
+	smtpTimeout = 30 * time.Second
+)
+
+var errNoEmailRecipients = errors.New("EMAIL_FROM and EMAIL_TO must be set to send email")
+
+// Mailer sends email through an SMTP server
+type Mailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// mailerFromEnv returns nil if SMTP_HOST isn't set
+func mailerFromEnv() (*Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+	m := &Mailer{
+		Host:     host,
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("EMAIL_FROM"),
+		To:       envList("EMAIL_TO"),
+	}
+	if m.Port == "" {
+		m.Port = defaultSMTPPort
+	}
+	if m.From == "" || len(m.To) == 0 {
+		return nil, errNoEmailRecipients
+	}
+	return m, nil
+}
+
+// Email is a message with a plain text body, and optionally an HTML one
+// for clients that show it
+type Email struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Send sends the email to all of the mailer's recipients
+func (m *Mailer) Send(ctx context.Context, e *Email) error {
+	msg, err := m.message(e, time.Now())
+	if err != nil {
+		return permanent(err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.Host, m.Port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	if m.Port == smtpsPort {
+		conn = tls.Client(conn, &tls.Config{ServerName: m.Host})
+	}
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return smtpError(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && m.Port != smtpsPort {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return smtpError(err)
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return smtpError(err)
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return smtpError(err)
+	}
+	for _, to := range m.To {
+		if err := c.Rcpt(to); err != nil {
+			return smtpError(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return c.Quit()
+}
+
+// smtpError marks 5xx replies as permanent, as retrying them won't help,
+// and 4xx replies as transient
+func smtpError(err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		if te.Code >= 500 {
+			return permanent(err)
+		}
+		return transient(err)
+	}
+	return err
+}
+
+func (m *Mailer) message(e *Email, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+	header("From", m.From)
+	header("To", strings.Join(m.To, ", "))
+	// encoded only if it isn't plain ASCII
+	header("Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+
+	if e.HTML == "" {
+		header("Content-Type", `text/plain; charset="utf-8"`)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, e.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", `multipart/alternative; boundary="`+parts.Boundary()+`"`)
+	buf.WriteString("\r\n")
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain", e.Text},
+		{"text/html", e.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType + `; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// emailNotifier sends events as emails
+type emailNotifier struct {
+	mailer *Mailer
+	retry  RetryPolicy
+}
+
+func newEmailNotifier(m *Mailer) *emailNotifier {
+	return &emailNotifier{mailer: m, retry: notifyRetry}
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, e *Event) error {
+	email := eventEmail(e)
+	return retryNotify(ctx, n.retry, func() error {
+		return n.mailer.Send(ctx, email)
+	})
+}
+
+func eventEmail(e *Event) *Email {
+	// errors can run to several lines, which don't belong in a subject
+	subject := e.Message
+	if i := strings.IndexByte(subject, '\n'); i >= 0 {
+		subject = subject[:i]
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s\n\n", e.Message)
+	for _, row := range [][2]string{
+		{"Event", e.Event},
+		{"App", fmt.Sprintf("%s (%s)", e.AppName, e.AppID)},
+		{"Backup", e.BackupID},
+		{"Time", e.Time.UTC().Format(time.RFC3339)},
+		{"Error", e.Error},
+	} {
+		if row[1] != "" {
+			fmt.Fprintf(&body, "%s: %s\n", row[0], row[1])
+		}
+	}
+	return &Email{Subject: "[pgbackups] " + subject, Text: body.String()}
+}
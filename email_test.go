@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is just enough of an SMTP server to receive mail
+type fakeSMTP struct {
+	ln       net.Listener
+	messages chan string
+	// recipients are rejected while set
+	reject int32
+	rcpts  int32
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, messages: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) mailer() *Mailer {
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	return &Mailer{Host: host, Port: port, From: "pgbackups@example.com", To: []string{"ops@example.com", "dba@example.com"}}
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 fake")
+		case "MAIL":
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			atomic.AddInt32(&s.rcpts, 1)
+			if atomic.LoadInt32(&s.reject) == 1 {
+				tp.PrintfLine("550 no such user")
+			} else {
+				tp.PrintfLine("250 ok")
+			}
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- string(data)
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) message(t *testing.T) string {
+	select {
+	case m := <-s.messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an email")
+		return ""
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.ln.Close()
+
+	n := newEmailNotifier(srv.mailer())
+	n.retry = RetryPolicy{MaxAttempts: 3}
+	e := &Event{Event: EventFailed, Time: time.Now(), AppID: "app-id", AppName: "web", BackupID: "backup-id", Message: "Backup of web failed: boom\nand more", Error: "boom\nand more"}
+	if err := n.Notify(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	msg := srv.message(t)
+	for _, s := range []string{
+		"From: pgbackups@example.com",
+		"To: ops@example.com, dba@example.com",
+		"Subject: [pgbackups] Backup of web failed: boom\n",
+		"Event: backup.failed",
+		"App: web (app-id)",
+		"Backup: backup-id",
+	} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("expected the email to contain %q, got:\n%s", s, msg)
+		}
+	}
+
+	// rejected recipients aren't retried
+	atomic.StoreInt32(&srv.reject, 1)
+	atomic.StoreInt32(&srv.rcpts, 0)
+	if err := n.Notify(context.Background(), e); err == nil {
+		t.Fatal("expected an error for a rejected recipient")
+	}
+	if rcpts := atomic.LoadInt32(&srv.rcpts); rcpts != 1 {
+		t.Errorf("expected 1 attempt, got %d", rcpts)
+	}
+}
+
+func TestMailerHTML(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.ln.Close()
+
+	err := srv.mailer().Send(context.Background(), &Email{Subject: "Digest für web", Text: "plain", HTML: "<p>rich</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := srv.message(t)
+	for _, s := range []string{
+		"Subject: =?utf-8?q?Digest_f=C3=BCr_web?=",
+		"Content-Type: multipart/alternative",
+		"Content-Type: text/plain",
+		"plain",
+		"Content-Type: text/html",
+		"<p>rich</p>",
+	} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("expected the email to contain %q, got:\n%s", s, msg)
+		}
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"syscall"
 
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/stream"
 )
 
+// pg_dump output format, stored with each backup
+const dumpFormat = "custom"
+
 type FlynnClient struct {
 	client controller.Client
 }
@@ -63,7 +71,11 @@ func (c *FlynnClient) AppList() ([]*AppAndRelease, error) {
 	result := []*AppAndRelease{}
 
 	for _, a := range allApps {
-		r, _ := c.client.GetAppRelease(a.ID)
+		r, err := c.client.GetAppRelease(a.ID)
+		if err != nil {
+			// apps without a release have nothing to back up
+			continue
+		}
 		// identify apps to backup by FLYNN_POSTGRES env var existing
 		if r.Env["FLYNN_POSTGRES"] != "" {
 			result = append(result, &AppAndRelease{App: a, Release: r})
@@ -73,8 +85,37 @@ func (c *FlynnClient) AppList() ([]*AppAndRelease, error) {
 	return result, nil
 }
 
-func (c *FlynnClient) StreamBackup(app *AppAndRelease, w io.Writer) error {
-	req, err := c.createPgBackupJobRequest(app)
+// Ping lists the apps without looking up their releases, to check that the
+// controller can be reached
+func (c *FlynnClient) Ping() error {
+	_, err := c.client.AppList()
+	return err
+}
+
+// GetAppAndRelease looks up an app by id or name, with its current release
+func (c *FlynnClient) GetAppAndRelease(appID string) (*AppAndRelease, error) {
+	app, err := c.client.GetApp(appID)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.client.GetAppRelease(app.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &AppAndRelease{App: app, Release: r}, nil
+}
+
+// StreamDeploymentEvents sends the events of every app's deployments to
+// output as they happen, until the stream is closed
+func (c *FlynnClient) StreamDeploymentEvents(output chan *ct.Event) (stream.Stream, error) {
+	return c.client.StreamEvents(ct.StreamEventsOptions{ObjectTypes: []ct.EventType{ct.EventTypeDeployment}}, output)
+}
+
+// StreamBackup runs pg_dump against the app's database, writing the dump to
+// w and its stderr to stderr.  If ctx is cancelled the job is sent SIGTERM
+// and the stream closed.
+func (c *FlynnClient) StreamBackup(ctx context.Context, app *AppAndRelease, w io.Writer, stderr io.Writer) error {
+	req, err := c.createPgJobRequest(app, []string{"pg_dump", "--format=" + dumpFormat, "--no-owner", "--no-acl"})
 	if err != nil {
 		return err
 	}
@@ -87,17 +128,168 @@ func (c *FlynnClient) StreamBackup(app *AppAndRelease, w io.Writer) error {
 
 	attachClient := cluster.NewAttachClient(rwc)
 	attachClient.CloseWrite()
+	defer stopOnDone(ctx, attachClient)()
 
-	// not worried about exit status...?
-	_, err = attachClient.Receive(w, os.Stderr)
+	// what pg_dump says about failing is kept for the error
+	errOut := &cappedBuffer{max: pgDumpErrorBytes}
+	exitStatus, err := attachClient.Receive(w, io.MultiWriter(stderr, errOut))
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if exitStatus != 0 {
+		out, _ := errOut.contents()
+		return pgDumpError(exitStatus, string(out))
+	}
+	return nil
+}
+
+// the most of pg_dump's stderr that goes into the error when it fails
+const pgDumpErrorBytes = 2 << 10
+
+// pg_dump's messages for failures that retrying won't fix, checked before
+// those for failures that it might, as a failed login also mentions the
+// connection
+var (
+	pgDumpPermanentMessages = []string{
+		"password authentication failed",
+		"no pg_hba.conf entry",
+		"permission denied",
+		"does not exist",
+		"server version mismatch",
+	}
+	pgDumpTransientMessages = []string{
+		"could not connect to server",
+		"connection to server",
+		"server closed the connection unexpectedly",
+		"terminating connection",
+		"the database system is starting up",
+		"the database system is shutting down",
+		"too many clients",
+		"could not obtain lock",
+		"deadlock detected",
+		"canceling statement due to conflict with recovery",
+	}
+)
+
+// pgDumpError is the error for pg_dump exiting with status, classified by
+// what it wrote to stderr
+func pgDumpError(status int, stderr string) error {
+	err := fmt.Errorf("pg_dump exited with status %d", status)
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		err = fmt.Errorf("pg_dump exited with status %d: %s", status, stderr)
+	}
+	for _, msg := range pgDumpPermanentMessages {
+		if strings.Contains(stderr, msg) {
+			return permanent(err)
+		}
+	}
+	for _, msg := range pgDumpTransientMessages {
+		if strings.Contains(stderr, msg) {
+			return transient(err)
+		}
+	}
 	return err
 }
 
-func (c *FlynnClient) createPgBackupJobRequest(app *AppAndRelease) (*ct.NewJob, error) {
+// StreamRestore restores a custom format dump read from r into the app's
+// database.  If ctx is cancelled the job is sent SIGTERM and the stream
+// closed.
+func (c *FlynnClient) StreamRestore(ctx context.Context, app *AppAndRelease, r io.Reader) error {
+	req, err := c.createPgJobRequest(app, []string{"pg_restore", "--clean", "--if-exists", "--no-owner", "--no-acl", "--dbname=" + app.Release.Env["PGDATABASE"]})
+	if err != nil {
+		return err
+	}
+
+	rwc, err := c.client.RunJobAttached(app.App.ID, req)
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+
+	attachClient := cluster.NewAttachClient(rwc)
+
+	go func() {
+		io.Copy(attachClient, r)
+		attachClient.CloseWrite()
+	}()
+	defer stopOnDone(ctx, attachClient)()
+
+	exitStatus, err := attachClient.Receive(os.Stdout, os.Stderr)
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if exitStatus != 0 {
+		return fmt.Errorf("pg_restore exited with status %d", exitStatus)
+	}
+	return nil
+}
+
+// changeMarkerQuery reads the database's own counts of rows inserted,
+// updated and deleted, which writes to other databases on a shared server
+// don't move, with when its statistics were last reset and when the server
+// started, as the counts go back to zero then.  the counts include aborted
+// writes, which only cost a dump.
+const changeMarkerQuery = `SELECT tup_inserted + tup_updated + tup_deleted, stats_reset, pg_postmaster_start_time()
+	FROM pg_stat_database WHERE datname = current_database()`
+
+// ChangeMarker runs a short psql job against the app's database, returning
+// a value that changes whenever the database is written to
+func (c *FlynnClient) ChangeMarker(ctx context.Context, app *AppAndRelease) (string, error) {
+	req, err := c.createPgJobRequest(app, []string{"psql", "--no-psqlrc", "--tuples-only", "--no-align", "--command", changeMarkerQuery})
+	if err != nil {
+		return "", err
+	}
+
+	rwc, err := c.client.RunJobAttached(app.App.ID, req)
+	if err != nil {
+		return "", err
+	}
+	defer rwc.Close()
+
+	attachClient := cluster.NewAttachClient(rwc)
+	attachClient.CloseWrite()
+	defer stopOnDone(ctx, attachClient)()
+
+	var out bytes.Buffer
+	exitStatus, err := attachClient.Receive(&out, os.Stderr)
+	if ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	if exitStatus != 0 {
+		return "", fmt.Errorf("psql exited with status %d", exitStatus)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// stopOnDone sends the job SIGTERM and closes its stream if ctx is done
+// before the returned func is called
+func stopOnDone(ctx context.Context, attachClient cluster.AttachClient) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			attachClient.Signal(int(syscall.SIGTERM))
+			attachClient.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (c *FlynnClient) createPgJobRequest(app *AppAndRelease, args []string) (*ct.NewJob, error) {
 	// from: https://github.com/flynn/flynn/blob/master/cli/pg.go
 	pgApp := app.Release.Env["FLYNN_POSTGRES"]
 	if pgApp == "" {
-		return nil, fmt.Errorf("no postgres database found.")
+		return nil, permanent(fmt.Errorf("no postgres database found."))
 	}
 
 	// TODO: this pgRelease is likely shared by all/most the apps.  cache result
@@ -107,7 +299,7 @@ func (c *FlynnClient) createPgBackupJobRequest(app *AppAndRelease) (*ct.NewJob,
 	}
 
 	req := &ct.NewJob{
-		Args:       []string{"pg_dump", "--format=custom", "--no-owner", "--no-acl"},
+		Args:       args,
 		TTY:        false,
 		ReleaseID:  pgRelease.ID,
 		ReleaseEnv: false,
@@ -118,7 +310,7 @@ func (c *FlynnClient) createPgBackupJobRequest(app *AppAndRelease) (*ct.NewJob,
 	for _, k := range []string{"PGHOST", "PGUSER", "PGPASSWORD", "PGDATABASE"} {
 		v := app.Release.Env[k]
 		if v == "" {
-			return nil, fmt.Errorf("missing %s in app environment", k)
+			return nil, permanent(fmt.Errorf("missing %s in app environment", k))
 		}
 		req.Env[k] = v
 	}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+)
+
+const (
+	// each check fails if it takes longer than this
+	healthCheckTimeout = 10 * time.Second
+	// the scheduler is dead if its cron hasn't ticked in this long
+	schedulerStaleAfter = 3 * time.Minute
+)
+
+var errHealthCheckTimeout = errors.New("timed out")
+
+type healthCheck func() error
+
+// HealthStatus is the response of the health endpoints.  Status is "ok" or
+// "failing", so that service checks can match on the body as well as the
+// status code.
+type HealthStatus struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks"`
+}
+
+type CheckResult struct {
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// runHealthChecks runs the checks at once, giving up on any that take longer
+// than healthCheckTimeout
+func runHealthChecks(checks map[string]healthCheck) *HealthStatus {
+	status := &HealthStatus{Status: "ok", Checks: make(map[string]*CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check healthCheck) {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- check() }()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(healthCheckTimeout):
+				err = errHealthCheckTimeout
+			}
+
+			result := &CheckResult{Status: "ok", Duration: time.Since(start).Seconds()}
+			if err != nil {
+				result.Status = "failing"
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			status.Checks[name] = result
+			if err != nil {
+				status.Status = "failing"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return status
+}
+
+func (s *HealthStatus) failing() []string {
+	names := []string{}
+	for name, c := range s.Checks {
+		if c.Status != "ok" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// schedulerCheck fails if the scheduler's cron has stopped ticking
+func schedulerCheck(s *Scheduler) healthCheck {
+	return func() error {
+		last := s.LastTick()
+		if last.IsZero() {
+			return errors.New("scheduler not started")
+		}
+		if since := time.Since(last); since > schedulerStaleAfter {
+			return fmt.Errorf("scheduler last ticked %s ago", since.Truncate(time.Second))
+		}
+		return nil
+	}
+}
+
+// livenessChecks are for whether the process should be restarted, so only
+// cover what a restart would fix
+func (a *API) livenessChecks() map[string]healthCheck {
+	checks := map[string]healthCheck{}
+	if a.Scheduler != nil {
+		checks["scheduler"] = schedulerCheck(a.Scheduler)
+	}
+	return checks
+}
+
+// readinessChecks are for whether the process can do its work, so also cover
+// what it depends on
+func (a *API) readinessChecks() map[string]healthCheck {
+	pgb := a.PgBackups
+	checks := a.livenessChecks()
+	checks["db"] = pgb.Repo.Ping
+	checks["store"] = pgb.Store.Ping
+	if pgb.FlynnClient != nil {
+		checks["controller"] = pgb.FlynnClient.Ping
+	}
+	return checks
+}
+
+func (a *API) healthz(w http.ResponseWriter, req *http.Request) {
+	a.serveHealth(w, "healthz", a.livenessChecks())
+}
+
+func (a *API) readyz(w http.ResponseWriter, req *http.Request) {
+	a.serveHealth(w, "readyz", a.readinessChecks())
+}
+
+func (a *API) serveHealth(w http.ResponseWriter, name string, checks map[string]healthCheck) {
+	status := runHealthChecks(checks)
+	code := http.StatusOK
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+		logger.Warn("Failing health checks", "endpoint", name, "failing", status.failing())
+	}
+	httphelper.JSON(w, code, status)
+}
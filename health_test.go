@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(t *testing.T) {
+	status := runHealthChecks(map[string]healthCheck{
+		"up":   func() error { return nil },
+		"down": func() error { return errors.New("unreachable") },
+	})
+	if status.Status != "failing" {
+		t.Errorf("expected failing, got %s", status.Status)
+	}
+	if c := status.Checks["up"]; c == nil || c.Status != "ok" {
+		t.Errorf("expected up to be ok, got %+v", c)
+	}
+	if c := status.Checks["down"]; c == nil || c.Status != "failing" || c.Error != "unreachable" {
+		t.Errorf("expected down to be failing, got %+v", c)
+	}
+
+	s := &Scheduler{}
+	if err := schedulerCheck(s)(); err == nil {
+		t.Error("expected a scheduler that hasn't started to fail")
+	}
+	s.lastTick.Store(time.Now().Add(-2 * schedulerStaleAfter).UnixNano())
+	if err := schedulerCheck(s)(); err == nil {
+		t.Error("expected a stale scheduler to fail")
+	}
+	s.tick()
+	if err := schedulerCheck(s)(); err != nil {
+		t.Errorf("expected a ticking scheduler to pass, got %s", err)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	api, srv := newTestAPI(t, nil)
+	defer srv.Close()
+	api.Scheduler = &Scheduler{}
+
+	get := func(path string) (int, *HealthStatus) {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		status := &HealthStatus{}
+		if err := json.NewDecoder(res.Body).Decode(status); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, status
+	}
+
+	// no key is needed, and the scheduler hasn't ticked
+	if code, status := get("/healthz"); code != 503 || status.Checks["scheduler"] == nil {
+		t.Errorf("expected healthz to fail on the scheduler, got %d %+v", code, status)
+	}
+
+	api.Scheduler.tick()
+	if code, status := get("/healthz"); code != 200 || status.Status != "ok" {
+		t.Errorf("expected healthz to pass, got %d %+v", code, status)
+	}
+	code, status := get("/readyz")
+	if code != 200 || status.Status != "ok" {
+		t.Errorf("expected readyz to pass, got %d %+v", code, status)
+	}
+	for _, name := range []string{"db", "store", "scheduler"} {
+		if status.Checks[name] == nil {
+			t.Errorf("expected readyz to check %s", name)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	api, srv := newTestAPI(t, []string{"key"})
+	defer srv.Close()
+	api.Scheduler = &Scheduler{}
+	api.Scheduler.tick()
+	health := httptest.NewServer(api.HealthHandler())
+	defer health.Close()
+
+	for path, expected := range map[string]int{"/healthz": 200, "/readyz": 200, "/apps": 404, "/dashboard": 404} {
+		req, _ := http.NewRequest("GET", health.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer key")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("expected %d for %s, got %d", expected, path, res.StatusCode)
+		}
+	}
+}
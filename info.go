@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// BackupInfo is everything known about a backup, for the info command
+type BackupInfo struct {
+	*Backup
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	// the dump's size over how long its last attempt took to stream
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"`
+	// where the dump and its manifest are stored, which for unchanged backups
+	// is where the backup they are the same as is
+	Locations      []string         `json:"locations"`
+	AttemptHistory []*BackupAttempt `json:"attempt_history"`
+}
+
+// BackupInfo loads b's logs and attempts, and works out where it's stored
+func (pgb *PgBackups) BackupInfo(b *Backup) (*BackupInfo, error) {
+	if err := pgb.Repo.LoadBackupLogs(b); err != nil {
+		return nil, err
+	}
+	attempts, err := pgb.Repo.GetAttempts(b.BackupID)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{Backup: b, AttemptHistory: attempts, Locations: []string{}}
+
+	if b.CompletedAt != nil && b.StartedAt != nil {
+		info.DurationSeconds = b.CompletedAt.Sub(*b.StartedAt).Seconds()
+	}
+	if b.Status == BackupStatusCompleted {
+		seconds := info.DurationSeconds
+		if n := len(attempts); n > 0 && attempts[n-1].StartedAt != nil && attempts[n-1].FinishedAt != nil {
+			seconds = attempts[n-1].FinishedAt.Sub(*attempts[n-1].StartedAt).Seconds()
+		}
+		if seconds > 0 {
+			info.BytesPerSecond = int64(float64(b.Bytes) / seconds)
+		}
+	}
+
+	if b.Status == BackupStatusCompleted || b.Status == BackupStatusUnchanged {
+		stored, err := pgb.StoredBackupFor(b)
+		if err != nil {
+			return nil, err
+		}
+		info.Locations = pgb.Store.Locations(stored.AppID, stored.BackupID)
+	}
+	return info, nil
+}
+
+// writeBackupInfo prints info as the info commands show it
+func writeBackupInfo(out io.Writer, info *BackupInfo) error {
+	b := info.Backup
+	duration, throughput := "", ""
+	if info.DurationSeconds > 0 {
+		duration = fmt.Sprintf("%.1fs", info.DurationSeconds)
+	}
+	if info.BytesPerSecond > 0 {
+		throughput = formatBytes(info.BytesPerSecond) + "/s"
+	}
+	verified := "never"
+	if b.VerifiedAt != nil {
+		verified = formatTime(b.VerifiedAt) + ", ok"
+		if b.VerifyError != "" {
+			verified = formatTime(b.VerifiedAt) + ", failed: " + b.VerifyError
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, row := range [][2]string{
+		{"ID", b.BackupID},
+		{"App", fmt.Sprintf("%s (%s)", b.AppName, b.AppID)},
+		{"Status", b.Status},
+		{"Trigger", b.Trigger},
+		{"Started", formatTime(b.StartedAt)},
+		{"Completed", formatTime(b.CompletedAt)},
+		{"Duration", duration},
+		{"Size", formatBytes(b.Bytes)},
+		{"Throughput", throughput},
+		{"Checksum", b.Checksum},
+		{"Format", b.Format},
+		{"Compression", orUnknown(b.Compression)},
+		{"Postgres", orUnknown(b.PgVersion)},
+		{"pg_dump", orUnknown(b.PgDumpVersion)},
+		{"Release", b.ReleaseID},
+		{"Deploy Release", b.DeployReleaseID},
+		{"Attempts", fmt.Sprint(b.Attempts)},
+		{"Pinned", fmt.Sprint(b.Pinned)},
+		{"Same As", b.SameAs},
+		{"Verified", verified},
+		{"Error", b.Error},
+	} {
+		if row[1] != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", row[0], row[1])
+		}
+	}
+	for i, l := range info.Locations {
+		label := ""
+		if i == 0 {
+			label = "Locations:"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", label, l)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(info.AttemptHistory) > 0 {
+		fmt.Fprintln(out, "\nAttempt history:")
+		w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, a := range info.AttemptHistory {
+			result := "ok"
+			if a.Error != "" {
+				result = firstLine(a.Error)
+			}
+			fmt.Fprintf(w, "  %d\t%s\t%s\t%s\n", a.Attempt, formatTime(a.StartedAt), formatTime(a.FinishedAt), result)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if b.Stderr != "" {
+		fmt.Fprintf(out, "\npg_dump stderr:\n%s", withNewline(b.Stderr))
+	}
+	if b.Log != "" {
+		fmt.Fprintf(out, "\nLog:\n%s", withNewline(b.Log))
+	}
+	return nil
+}
+
+// backups taken before their dump's header was read don't know what it says
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func withNewline(s string) string {
+	if strings.HasSuffix(s, "\n") {
+		return s
+	}
+	return s + "\n"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestBackupInfo(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgb := &PgBackups{Repo: repo, Store: newMemStore()}
+
+	appID := random.UUID()
+	b, err := repo.NewBackup(appID, "test", TriggerDeploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(b)
+	repo.RecordAttempt(b, 1, time.Now(), errors.New("connection reset by peer\nwhile dumping"))
+	repo.RecordAttempt(b, 2, time.Now(), nil)
+	header := &DumpHeader{Compression: "gzip (default level)", ServerVersion: "15.4", PgDumpVersion: "16.1"}
+	repo.SetDumpDetails(b, header, "pg_dump: warning: could not lock table\n")
+	repo.CompleteBackup(b, 1234, "abc123")
+
+	info, err := pgb.BackupInfo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.AttemptHistory) != 2 || info.Stderr == "" || len(info.Locations) != 1 || info.Locations[0] != "mem://"+appID+"/"+b.BackupID {
+		t.Errorf("expected two attempts, stderr and a location, got %+v", info)
+	}
+
+	var out bytes.Buffer
+	if err := writeBackupInfo(&out, info); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Trigger:", "deploy", "Postgres:", "15.4", "pg_dump:", "16.1", "Verified:", "never", "connection reset by peer", "could not lock table", "mem://"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "while dumping") {
+		t.Errorf("expected only the first line of attempt errors, got:\n%s", out.String())
+	}
+
+	// unchanged backups are found where the backup they are the same as is
+	unchanged, err := repo.NewBackup(appID, "test", TriggerSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(unchanged)
+	repo.UnchangedBackup(unchanged, b)
+	info, err = pgb.BackupInfo(unchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Locations) != 1 || !strings.HasSuffix(info.Locations[0], b.BackupID) || info.PgVersion != "15.4" {
+		t.Errorf("expected the location and versions of %s, got %+v", b.BackupID, info)
+	}
+}
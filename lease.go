@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+const (
+	// held by the worker that schedules backups
+	schedulerLease  = "scheduler"
+	defaultLeaseTTL = time.Minute
+)
+
+var (
+	errAppLocked = errors.New("a backup of this app is already running")
+	// another worker may be backing the app up by then, so the backup isn't
+	// retried
+	errAppLockLost = permanent(errors.New("lost the lock on the app to another worker"))
+)
+
+// Lease is a named lock in postgres that expires unless it is renewed, so
+// that it passes to another holder if this process dies
+type Lease struct {
+	repo   *BackupRepo
+	name   string
+	holder string
+	ttl    time.Duration
+	held   atomic.Bool
+	// called by Run each time the lease is newly acquired, and each time
+	// another holder is found to have it after it was held
+	onAcquire func()
+	onLose    func()
+}
+
+func NewLease(repo *BackupRepo, name string, holder string, ttl time.Duration) *Lease {
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	return &Lease{repo: repo, name: name, holder: holder, ttl: ttl}
+}
+
+// TryAcquire acquires or renews the lease, returning whether it is held
+func (l *Lease) TryAcquire() (bool, error) {
+	held, err := l.repo.AcquireLease(l.name, l.holder, l.ttl)
+	if err != nil {
+		held = false
+	}
+	l.held.Store(held)
+	return held, err
+}
+
+func (l *Lease) Held() bool {
+	return l.held.Load()
+}
+
+// Run keeps trying to acquire, then renew, the lease until ctx is done, at
+// which point it is released
+func (l *Lease) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		wasHeld := l.Held()
+		held, err := l.TryAcquire()
+		if err != nil {
+			logger.Error("Error acquiring lease", "lease", l.name, "err", err)
+		}
+		if held && !wasHeld {
+			logger.Info("Acquired lease", "lease", l.name, "holder", l.holder)
+			if l.onAcquire != nil {
+				l.onAcquire()
+			}
+		} else if !held && wasHeld {
+			logger.Warn("Lost lease", "lease", l.name, "holder", l.holder)
+			// an error doesn't mean someone else has it, it may be renewed
+			// on the next tick
+			if err == nil && l.onLose != nil {
+				l.onLose()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			l.Release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *Lease) Release() {
+	l.held.Store(false)
+	if err := l.repo.ReleaseLease(l.name, l.holder); err != nil {
+		logger.Error("Error releasing lease", "lease", l.name, "err", err)
+	}
+}
+
+// lockApp prevents other backups of the app from running until the returned
+// function is called.  The returned context is cancelled with errAppLockLost
+// if another worker takes the lock in the meantime, such as after this one
+// couldn't renew it for longer than the TTL.
+func (pgb *PgBackups) lockApp(ctx context.Context, appID string) (context.Context, func(), error) {
+	l := NewLease(pgb.Repo, "app:"+appID, random.UUID(), pgb.LeaseTTL)
+	held, err := l.TryAcquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !held {
+		return nil, nil, errAppLocked
+	}
+
+	ctx, lose := context.WithCancelCause(ctx)
+	l.onLose = func() { lose(errAppLockLost) }
+	leaseCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(leaseCtx)
+		close(done)
+	}()
+	return ctx, func() {
+		cancel()
+		<-done
+		lose(nil)
+	}, nil
+}
+
+// workerID identifies this process as a lease holder
+func workerID() string {
+	if id := os.Getenv("FLYNN_JOB_ID"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname + "-" + random.UUID()
+}
+
+func (r *BackupRepo) AcquireLease(name string, holder string, ttl time.Duration) (bool, error) {
+	var acquired int
+	err := r.db.QueryRow(`
+	WITH acquired AS (
+		INSERT INTO pgbackups_leases (name, holder, expires_at)
+		VALUES ($1, $2, now() + $3 * interval '1 millisecond')
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE pgbackups_leases.holder = EXCLUDED.holder OR pgbackups_leases.expires_at < now()
+		RETURNING holder
+	)
+	SELECT count(*) FROM acquired`, name, holder, int64(ttl/time.Millisecond)).Scan(&acquired)
+	return acquired == 1, err
+}
+
+func (r *BackupRepo) ReleaseLease(name string, holder string) error {
+	return r.db.Exec("DELETE FROM pgbackups_leases WHERE name = $1 AND holder = $2", name, holder)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestLease(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "test-" + random.UUID()
+	a := NewLease(repo, name, "a", time.Second)
+	b := NewLease(repo, name, "b", time.Second)
+
+	if held, err := a.TryAcquire(); err != nil || !held {
+		t.Fatalf("expected a to acquire the lease, got %t %v", held, err)
+	}
+	if held, err := a.TryAcquire(); err != nil || !held {
+		t.Fatalf("expected a to renew the lease, got %t %v", held, err)
+	}
+	if held, _ := b.TryAcquire(); held {
+		t.Fatal("expected b not to acquire a held lease")
+	}
+
+	// expired leases can be taken over
+	time.Sleep(1500 * time.Millisecond)
+	if held, err := b.TryAcquire(); err != nil || !held {
+		t.Fatalf("expected b to acquire the expired lease, got %t %v", held, err)
+	}
+	if held, _ := a.TryAcquire(); held {
+		t.Fatal("expected a to have lost the lease")
+	}
+
+	b.Release()
+	if held, err := a.TryAcquire(); err != nil || !held {
+		t.Fatalf("expected a to acquire the released lease, got %t %v", held, err)
+	}
+	a.Release()
+}
+
+func TestLockApp(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgb := &PgBackups{Repo: repo, LeaseTTL: time.Second}
+
+	appID := random.UUID()
+	_, unlock, err := pgb.lockApp(context.Background(), appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pgb.lockApp(context.Background(), appID); err != errAppLocked {
+		t.Errorf("expected %s, got %v", errAppLocked, err)
+	}
+	unlock()
+
+	ctx, unlock, err := pgb.lockApp(context.Background(), appID)
+	if err != nil {
+		t.Fatalf("expected to lock the unlocked app, got %s", err)
+	}
+	defer unlock()
+
+	// another worker taking the lock cancels the backup, rather than both
+	// running
+	if err := db.Exec("UPDATE pgbackups_leases SET holder = 'other', expires_at = now() + interval '1 minute' WHERE name = $1", "app:"+appID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+		if context.Cause(ctx) != errAppLockLost {
+			t.Errorf("expected %s, got %v", errAppLockLost, context.Cause(ctx))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected losing the lock to cancel the backup")
+	}
+}
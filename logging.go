@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// the most of a backup's log that is stored with it
+const maxBackupLogBytes = 64 << 10
+
+var (
+	// logHandler is where every log goes, set up from LOG_LEVEL and
+	// LOG_FORMAT by setupLogging
+	logHandler = log15.StdoutHandler
+	logger     = log15.New()
+)
+
+// setupLogging filters logs to LOG_LEVEL (defaulting to info), formatted as
+// LOG_FORMAT: logfmt (the default), json or terminal
+func setupLogging() error {
+	lvl := log15.LvlInfo
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		var err error
+		if lvl, err = log15.LvlFromString(strings.ToLower(s)); err != nil {
+			return fmt.Errorf("error parsing LOG_LEVEL: %s", err)
+		}
+	}
+
+	var format log15.Format
+	switch os.Getenv("LOG_FORMAT") {
+	case "", "logfmt":
+		format = log15.LogfmtFormat()
+	case "json":
+		format = log15.JsonFormat()
+	case "terminal":
+		format = log15.TerminalFormat()
+	default:
+		return fmt.Errorf("unknown LOG_FORMAT %q, expected logfmt, json or terminal", os.Getenv("LOG_FORMAT"))
+	}
+
+	logHandler = log15.LvlFilterHandler(lvl, log15.StreamHandler(os.Stdout, format))
+	log15.Root().SetHandler(logHandler)
+	return nil
+}
+
+// backupLogFields are on every line of a backup's log, so aren't repeated
+// in the log stored with it
+var backupLogFields = []string{"app", "app_id", "backup_id"}
+
+// backupLog keeps the log lines of a backup at every level, whatever
+// LOG_LEVEL is, to be stored with it
+type backupLog struct {
+	mu        sync.Mutex
+	buf       strings.Builder
+	truncated bool
+}
+
+func (l *backupLog) Log(r *log15.Record) error {
+	ctx := make([]interface{}, 0, len(r.Ctx))
+	for i := 0; i+1 < len(r.Ctx); i += 2 {
+		if k, ok := r.Ctx[i].(string); ok && contains(backupLogFields, k) {
+			continue
+		}
+		ctx = append(ctx, r.Ctx[i], r.Ctx[i+1])
+	}
+	rec := *r
+	rec.Ctx = ctx
+	line := log15.LogfmtFormat().Format(&rec)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.truncated {
+		return nil
+	}
+	if l.buf.Len()+len(line) > maxBackupLogBytes {
+		l.buf.WriteString("... log truncated\n")
+		l.truncated = true
+		return nil
+	}
+	l.buf.Write(line)
+	return nil
+}
+
+func (l *backupLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// startLog gives b a logger that also writes to a log of its own, which is
+// returned to be stored once the backup ends
+func (b *Backup) startLog() *backupLog {
+	bl := &backupLog{}
+	b.log = logger.New("app", b.AppName, "app_id", b.AppID, "backup_id", b.BackupID)
+	b.log.SetHandler(log15.MultiHandler(logHandler, bl))
+	return bl
+}
+
+// logger returns the backup's logger, with its fields
+func (b *Backup) logger() log15.Logger {
+	if b.log != nil {
+		return b.log
+	}
+	return logger.New("app", b.AppName, "app_id", b.AppID, "backup_id", b.BackupID)
+}
+
+func (j *Job) logger() log15.Logger {
+	ctx := []interface{}{"job_id", j.JobID, "kind", j.Kind}
+	if j.AppID != "" {
+		ctx = append(ctx, "app_id", j.AppID)
+	}
+	if j.BackupID != "" {
+		ctx = append(ctx, "backup_id", j.BackupID)
+	}
+	return logger.New(ctx...)
+}
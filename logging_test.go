@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBackupLog(t *testing.T) {
+	b := newBackup("app-id", "web", TriggerManual)
+	bl := b.startLog()
+	b.logger().Info("Dumped database", "phase", PhaseDumping, "bytes", 2048)
+	b.logger().Debug("Starting phase", "phase", PhasePruning)
+
+	log := bl.String()
+	for _, s := range []string{`msg="Dumped database"`, "phase=dumping", "bytes=2048", "lvl=dbug"} {
+		if !strings.Contains(log, s) {
+			t.Errorf("expected the log to contain %q, got:\n%s", s, log)
+		}
+	}
+	// these are on every line, so aren't stored
+	for _, s := range []string{"app=", "app_id=", "backup_id="} {
+		if strings.Contains(log, s) {
+			t.Errorf("expected the log not to contain %q, got:\n%s", s, log)
+		}
+	}
+
+	for i := 0; i < maxBackupLogBytes/10; i++ {
+		b.logger().Debug("Filling the log")
+	}
+	log = bl.String()
+	if len(log) > maxBackupLogBytes+100 || !strings.HasSuffix(log, "... log truncated\n") {
+		t.Errorf("expected the log to be truncated, got %d bytes ending %q", len(log), log[len(log)-50:])
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer os.Unsetenv("LOG_LEVEL")
+	defer os.Unsetenv("LOG_FORMAT")
+	defer setupLogging()
+
+	os.Setenv("LOG_LEVEL", "WARN")
+	os.Setenv("LOG_FORMAT", "json")
+	if err := setupLogging(); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LOG_LEVEL", "loud")
+	if err := setupLogging(); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	os.Setenv("LOG_LEVEL", "")
+	os.Setenv("LOG_FORMAT", "xml")
+	if err := setupLogging(); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"time"
+
+	"github.com/flynn/flynn/pkg/shutdown"
 )
 
 func main() {
+	// the client only talks to the API, so needs none of the worker's config
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		runClient(os.Args[2:])
+		os.Exit(0)
+	}
+
+	if err := setupLogging(); err != nil {
+		panic(err)
+	}
+
 	pgb, err := NewPgBackups()
 	if err != nil {
 		panic(err)
@@ -14,11 +30,20 @@ func main() {
 	action := os.Args[1]
 
 	switch action {
-	case "worker":
-		runScheduler(pgb)
+	case "worker", "web":
+		runScheduler(pgb, action == "web")
 		break
 	case "run":
-		pgb.BackupAll()
+		runBackups(pgb)
+		break
+	case "restore":
+		restoreBackup(pgb)
+		break
+	case "verify":
+		verifyBackup(pgb)
+		break
+	case "jobs":
+		listJobs(pgb)
 		break
 	case "list":
 		listBackups(pgb)
@@ -26,16 +51,202 @@ func main() {
 	case "url":
 		backupUrl(pgb)
 		break
+	case "reconcile":
+		reconcile(pgb)
+		break
+	case "catalog":
+		catalog(pgb)
+		break
+	case "self":
+		self(pgb)
+		break
+	case "cancel":
+		cancelBackup(pgb)
+		break
+	case "schedule":
+		schedule(pgb)
+		break
+	case "blackout":
+		blackout(pgb)
+		break
+	case "digest":
+		digest(pgb)
+		break
+	case "info":
+		info(pgb)
+		break
 	}
 	os.Exit(0)
 }
 
-func runScheduler(pgb *PgBackups) {
+// runScheduler runs the scheduler and claims jobs.  Given a port, web
+// processes serve the API on it, and workers only the health checks.
+func runScheduler(pgb *PgBackups, web bool) {
+	s, err := newSchedulerFromEnv(pgb)
+	if err != nil {
+		panic(err)
+	}
+
+	go pgb.ListenForCancels(context.Background())
+	go pgb.RunJobs(context.Background(), workerID())
+
+	// flynn only gives processes a port if they have one, like web
+	if port := os.Getenv("PORT"); port != "" {
+		api := NewAPI(pgb, apiKeys(os.Getenv("API_KEYS")))
+		api.Scheduler = s
+		api.SessionTTL = envDuration("DASHBOARD_SESSION_TTL", defaultSessionTTL)
+		go func() {
+			serve := api.ServeHealth
+			if web {
+				serve = api.ListenAndServe
+			}
+			if err := serve(":" + port); err != nil {
+				logger.Error("Error serving API", "err", err)
+			}
+		}()
+	}
+
+	// the shutdown package exits on SIGTERM once these have run
+	shutdown.BeforeExit(func() { s.Stop(shutdownGracePeriod()) })
+	if err := s.Run(); err != nil {
+		panic(err)
+	}
+}
+
+func newSchedulerFromEnv(pgb *PgBackups) (*Scheduler, error) {
 	s := NewScheduler(pgb, os.Getenv("SCHEDULE"))
-	err := s.Run()
+	s.Window = envDuration("SCHEDULE_WINDOW", 0)
+	s.SelfBackup = os.Getenv("SELF_BACKUP") != "false"
+	s.DeployBackups = os.Getenv("DEPLOY_BACKUPS") != "false"
+	s.ReconcileCronLine = os.Getenv("RECONCILE_SCHEDULE")
+	s.ReconcileFix = os.Getenv("RECONCILE_FIX") == "true"
+	s.DigestCronLine = os.Getenv("DIGEST_SCHEDULE")
+	if policy := os.Getenv("CATCHUP_POLICY"); policy != "" {
+		if policy != CatchupOnce && policy != CatchupSkip {
+			return nil, fmt.Errorf("unknown CATCHUP_POLICY %q, expected %q or %q", policy, CatchupOnce, CatchupSkip)
+		}
+		s.CatchupPolicy = policy
+	}
+	return s, nil
+}
+
+func shutdownGracePeriod() time.Duration {
+	return envDuration("SHUTDOWN_GRACE_PERIOD", time.Minute)
+}
+
+// waitFlag parses the flags of commands that queue jobs, returning the
+// remaining args
+func waitFlag(name string) (bool, []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	wait := flags.Bool("wait", false, "wait for the job to finish")
+	flags.Parse(os.Args[2:])
+	return *wait, flags.Args()
+}
+
+func waitForJobs(pgb *PgBackups, jobs []*Job) {
+	failed := false
+	for _, j := range jobs {
+		j, err := pgb.WaitForJob(j.JobID)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%s %s - %s\n", j.Kind, j.JobID, j.Status)
+		if j.Status == JobStatusFailed {
+			fmt.Printf("  error: %s\n", j.Error)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runBackups(pgb *PgBackups) {
+	wait, args := waitFlag("run")
+	// all apps unless one is named
+	appName := ""
+	if len(args) > 0 {
+		appName = args[0]
+	}
+
+	jobs, err := pgb.EnqueueBackups(TriggerManual, appName)
 	if err != nil {
 		panic(err)
 	}
+	for _, j := range jobs {
+		fmt.Printf("Queued backup job %s for %s\n", j.JobID, j.AppID)
+	}
+	if wait {
+		waitForJobs(pgb, jobs)
+	}
+}
+
+func restoreBackup(pgb *PgBackups) {
+	wait, args := waitFlag("restore")
+	if len(args) < 1 || args[0] == "" {
+		panic("Backup id must be given (pgbackups restore [--wait] [backup id] [appname])")
+	}
+	// defaults to the app the backup was taken from
+	appName := ""
+	if len(args) > 1 {
+		appName = args[1]
+	}
+
+	b, err := pgb.Repo.GetBackup(args[0])
+	if err != nil {
+		panic(err)
+	}
+	if b == nil {
+		panic("Backup not found")
+	}
+
+	j, err := pgb.EnqueueRestore(b, appName)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Queued restore job %s\n", j.JobID)
+	if wait {
+		waitForJobs(pgb, []*Job{j})
+	}
+}
+
+func verifyBackup(pgb *PgBackups) {
+	wait, args := waitFlag("verify")
+	if len(args) < 1 || args[0] == "" {
+		panic("Backup id must be given (pgbackups verify [--wait] [backup id])")
+	}
+
+	b, err := pgb.Repo.GetBackup(args[0])
+	if err != nil {
+		panic(err)
+	}
+	if b == nil {
+		panic("Backup not found")
+	}
+
+	j, err := pgb.EnqueueVerify(b)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Queued verify job %s\n", j.JobID)
+	if wait {
+		waitForJobs(pgb, []*Job{j})
+	}
+}
+
+func listJobs(pgb *PgBackups) {
+	jobs, err := pgb.Repo.GetJobs(50)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("  [ID] - [Kind] - [App] - [Backup] - [Status] - [Run At] - [Worker] - [Attempts]")
+	for _, j := range jobs {
+		fmt.Printf("  %s - %s - %s - %s - %s - %s - %s - %d\n", j.JobID, j.Kind, j.AppID, j.BackupID, j.Status, j.RunAt, j.WorkerID, j.Attempts)
+		if j.Status == JobStatusFailed {
+			fmt.Printf("    error: %s\n", j.Error)
+		}
+	}
 }
 
 func listBackups(pgb *PgBackups) {
@@ -62,9 +273,18 @@ func listBackups(pgb *PgBackups) {
 	}
 
 	fmt.Printf("App: %s ID: %s\n", app.Name, app.ID)
-	fmt.Println("  [ID] - [Started] - [Completed] - [Bytes]")
+	fmt.Println("  [ID] - [Started] - [Completed] - [Bytes] - [Status] - [Attempts] - [Trigger]")
 	for _, b := range backups {
-		fmt.Printf("  %s - %s - %s - %d\n", b.BackupID, b.StartedAt, b.CompletedAt, b.Bytes)
+		fmt.Printf("  %s - %s - %s - %d - %s - %d - %s\n", b.BackupID, b.StartedAt, b.CompletedAt, b.Bytes, b.Status, b.Attempts, b.Trigger)
+		if b.Status == BackupStatusUnchanged {
+			fmt.Printf("    same as: %s\n", b.SameAs)
+		}
+		if b.Trigger == TriggerDeploy {
+			fmt.Printf("    before deploying release: %s\n", b.DeployReleaseID)
+		}
+		if b.Status == BackupStatusFailed {
+			fmt.Printf("    error: %s\n", b.Error)
+		}
 	}
 }
 
@@ -81,6 +301,10 @@ func backupUrl(pgb *PgBackups) {
 	if err != nil || b == nil {
 		panic(err)
 	}
+	b, err = pgb.StoredBackupFor(b)
+	if err != nil {
+		panic(err)
+	}
 
 	url, err := pgb.Store.DownloadUrl(b.AppID, b.BackupID)
 	if err != nil {
@@ -88,3 +312,257 @@ func backupUrl(pgb *PgBackups) {
 	}
 	fmt.Println(url)
 }
+
+func info(pgb *PgBackups) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the backup as JSON")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() < 1 || flags.Arg(0) == "" {
+		panic("Backup id must be given (pgbackups info [--json] [backup id])")
+	}
+
+	b, err := pgb.Repo.GetBackup(flags.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+	if b == nil {
+		panic("Backup " + flags.Arg(0) + " not found")
+	}
+	info, err := pgb.BackupInfo(b)
+	if err != nil {
+		panic(err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if err := writeBackupInfo(os.Stdout, info); err != nil {
+		panic(err)
+	}
+}
+
+func reconcile(pgb *PgBackups) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "fix any differences found")
+	flags.Parse(os.Args[2:])
+
+	report, err := pgb.Reconcile(*fix)
+	if err != nil && err != errEmptyCatalog {
+		panic(err)
+	}
+
+	fmt.Println("Orphaned objects (no backup row or manifest):")
+	for _, o := range report.OrphanedObjects {
+		fmt.Printf("  %s - %s - %d\n", o.AppID, o.BackupID, o.Bytes)
+	}
+	fmt.Println("Uncataloged objects (no backup row, restored by catalog rebuild):")
+	for _, o := range report.UncatalogedObjects {
+		fmt.Printf("  %s - %s - %d\n", o.AppID, o.BackupID, o.Bytes)
+	}
+	fmt.Println("Failed objects (stored for a failed, cancelled or unchanged backup):")
+	for _, o := range report.FailedObjects {
+		fmt.Printf("  %s - %s - %d\n", o.AppID, o.BackupID, o.Bytes)
+	}
+	fmt.Println("Missing objects (no stored backup):")
+	for _, b := range report.MissingObjects {
+		fmt.Printf("  %s - %s - %s\n", b.AppID, b.BackupID, b.StartedAt)
+	}
+	fmt.Println("Stale backups (never completed):")
+	for _, b := range report.StaleBackups {
+		fmt.Printf("  %s - %s - %s\n", b.AppID, b.BackupID, b.StartedAt)
+	}
+	fmt.Println("Size mismatches [recorded] - [stored]:")
+	for _, m := range report.SizeMismatches {
+		fmt.Printf("  %s - %s - %d - %d\n", m.Backup.AppID, m.Backup.BackupID, m.RecordedBytes, m.StoredBytes)
+	}
+	if err == errEmptyCatalog {
+		panic(err)
+	}
+	if *fix && !report.Clean() {
+		fmt.Println("Fixed")
+	}
+}
+
+func catalog(pgb *PgBackups) {
+	if len(os.Args) < 3 || os.Args[2] != "rebuild" {
+		panic("Catalog action must be given (pgbackups catalog [rebuild])")
+	}
+
+	restored, missing, err := pgb.RebuildCatalog()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Restored %d backups from manifests, %d stored backups had no manifest\n", restored, missing)
+}
+
+func self(pgb *PgBackups) {
+	if len(os.Args) < 3 {
+		panic("Self action must be given (pgbackups self [backup|list|restore])")
+	}
+
+	switch os.Args[2] {
+	case "backup":
+		b, err := pgb.BackupSelf(context.Background(), nil)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Backed up pgbackups database: %s - %d\n", b.BackupID, b.Bytes)
+	case "list":
+		stored, err := pgb.ListSelfBackups()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("  [ID] - [Stored] - [Bytes]")
+		for _, b := range stored {
+			fmt.Printf("  %s - %s - %d\n", b.BackupID, b.LastModified, b.Bytes)
+		}
+	case "restore":
+		// defaults to the most recent backup
+		backupID := ""
+		if len(os.Args) > 3 {
+			backupID = os.Args[3]
+		}
+		if err := pgb.RestoreSelf(backupID); err != nil {
+			panic(err)
+		}
+		fmt.Println("Restored pgbackups database")
+	default:
+		panic("Unknown self action (pgbackups self [backup|list|restore])")
+	}
+}
+
+func cancelBackup(pgb *PgBackups) {
+	if len(os.Args) < 3 || os.Args[2] == "" {
+		panic("Backup id must be given (pgbackups cancel [backup id])")
+	}
+
+	if err := pgb.RequestCancel(os.Args[2]); err != nil {
+		panic(err)
+	}
+	fmt.Println("Cancel requested")
+}
+
+func schedule(pgb *PgBackups) {
+	if len(os.Args) < 3 || os.Args[2] != "show" {
+		panic("Schedule action must be given (pgbackups schedule [show])")
+	}
+
+	s, err := newSchedulerFromEnv(pgb)
+	if err != nil {
+		panic(err)
+	}
+	apps, err := pgb.AppsToBackUp()
+	if err != nil {
+		panic(err)
+	}
+	blackouts, err := pgb.Repo.GetBlackouts()
+	if err != nil {
+		panic(err)
+	}
+	runs, err := s.NextRuns(apps, blackouts, time.Now())
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Schedule: %s Window: %s\n", s.CronLine, s.Window)
+	fmt.Println("  [App] - [ID] - [Offset] - [Next Run]")
+	for _, a := range apps {
+		fmt.Printf("  %s - %s - %s - %s\n", a.App.Name, a.App.ID, appOffset(a.App.ID, s.Window), runs[a.App.ID])
+	}
+}
+
+func blackout(pgb *PgBackups) {
+	if len(os.Args) < 3 {
+		panic("Blackout action must be given (pgbackups blackout [add|remove|list])")
+	}
+
+	switch os.Args[2] {
+	case "add":
+		flags := flag.NewFlagSet("blackout add", flag.ExitOnError)
+		appName := flags.String("app", "", "only block backups of this app")
+		sched := flags.String("schedule", "", "start a window at each run of this cron line")
+		duration := flags.Duration("duration", 0, "how long each scheduled window lasts")
+		from := flags.String("from", "", "start of a one-off window, in RFC3339 format")
+		to := flags.String("to", "", "end of a one-off window, in RFC3339 format")
+		reason := flags.String("reason", "", "why backups are blocked")
+		flags.Parse(os.Args[3:])
+
+		b := &Blackout{Schedule: *sched, Duration: *duration, Reason: *reason}
+		if *appName != "" {
+			app, err := pgb.FlynnClient.GetApp(*appName)
+			if err != nil {
+				panic(err)
+			}
+			b.AppID = app.ID
+		}
+		b.StartsAt = parseTimeFlag(*from)
+		b.EndsAt = parseTimeFlag(*to)
+
+		if err := pgb.Repo.AddBlackout(b); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Added blackout %s\n", b.BlackoutID)
+	case "remove":
+		if len(os.Args) < 4 || os.Args[3] == "" {
+			panic("Blackout id must be given (pgbackups blackout remove [blackout id])")
+		}
+		if err := pgb.Repo.RemoveBlackout(os.Args[3]); err != nil {
+			panic(err)
+		}
+		fmt.Println("Removed blackout")
+	case "list":
+		blackouts, err := pgb.Repo.GetBlackouts()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("  [ID] - [App] - [Window] - [Reason]")
+		for _, b := range blackouts {
+			app := b.AppID
+			if app == "" {
+				app = "all"
+			}
+			window := fmt.Sprintf("%s to %s", b.StartsAt, b.EndsAt)
+			if b.Schedule != "" {
+				window = fmt.Sprintf("%s for %s", b.Schedule, b.Duration)
+			}
+			fmt.Printf("  %s - %s - %s - %s\n", b.BlackoutID, app, window, b.Reason)
+		}
+	default:
+		panic("Unknown blackout action (pgbackups blackout [add|remove|list])")
+	}
+}
+
+func parseTimeFlag(value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return &t
+}
+
+func digest(pgb *PgBackups) {
+	flags := flag.NewFlagSet("digest", flag.ExitOnError)
+	send := flags.Bool("send", false, "email the digest rather than printing it")
+	flags.Parse(os.Args[2:])
+
+	if *send {
+		if err := pgb.SendDigest(context.Background(), time.Now()); err != nil {
+			panic(err)
+		}
+		fmt.Println("Sent digest")
+		return
+	}
+	d, err := pgb.Digest(time.Now())
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(d.Text())
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/jackc/pgx"
 )
@@ -57,6 +63,50 @@ func TestKeepingBackups(t *testing.T) {
 	}
 }
 
+func TestKeepingDeployBackups(t *testing.T) {
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	for old.Day() == 1 {
+		old = old.Add(24 * time.Hour)
+	}
+	backups := []*Backup{}
+	for i := 0; i < 4; i++ {
+		d := old.Add(time.Duration(i) * time.Hour)
+		backups = append(backups, &Backup{BackupID: string('a' + rune(i)), StartedAt: &d, Trigger: TriggerDeploy, Status: BackupStatusCompleted})
+	}
+	scheduled := &Backup{BackupID: "scheduled", StartedAt: &old, Trigger: TriggerSchedule, Status: BackupStatusCompleted}
+	failed := &Backup{BackupID: "failed", StartedAt: &old, Trigger: TriggerDeploy, Status: BackupStatusFailed}
+	backups = append(backups, scheduled, failed)
+
+	// only the oldest deploy backups past the count go, however old the
+	// rest are, and the others follow the usual rules
+	deleted := map[string]bool{}
+	for _, b := range backupsToDelete(backups, 2) {
+		deleted[b.BackupID] = true
+	}
+	if len(deleted) != 4 || !deleted["a"] || !deleted["b"] || !deleted["scheduled"] || !deleted["failed"] {
+		t.Errorf("expected a, b, scheduled and failed to be deleted, got %v", deleted)
+	}
+}
+
+func TestKeepingUnchangedBackups(t *testing.T) {
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	for old.Day() == 1 {
+		old = old.Add(24 * time.Hour)
+	}
+	recent := time.Now().Add(-24 * time.Hour)
+	backups := []*Backup{
+		{BackupID: "old", StartedAt: &old, Status: BackupStatusCompleted},
+		{BackupID: "older-unchanged", StartedAt: &old, Status: BackupStatusUnchanged, SameAs: "old"},
+		{BackupID: "unchanged", StartedAt: &recent, Status: BackupStatusUnchanged, SameAs: "old"},
+	}
+
+	// the old backup is kept for the recent unchanged one
+	toDelete := backupsToDelete(backups, 0)
+	if len(toDelete) != 1 || toDelete[0].BackupID != "older-unchanged" {
+		t.Errorf("expected only older-unchanged to be deleted, got %v", toDelete)
+	}
+}
+
 func setupTestDb() (*postgres.DB, error) {
 	dbname := "pgbackupstest"
 
@@ -119,21 +169,117 @@ func setupDatabase(dbname string) error {
 	return nil
 }
 
-type dummyStore struct {
+type memStore struct {
+	objects   map[string]*StoredBackup
+	manifests map[string]*Manifest
+}
+
+// fakeController serves apps and their releases, failing anything else
+type fakeController struct {
+	controller.Client
+	apps     map[string]*ct.App
+	releases map[string]*ct.Release
+}
+
+func newFakeController(apps ...*AppAndRelease) *fakeController {
+	c := &fakeController{apps: make(map[string]*ct.App), releases: make(map[string]*ct.Release)}
+	for _, a := range apps {
+		c.apps[a.App.ID] = a.App
+		c.apps[a.App.Name] = a.App
+		c.releases[a.App.ID] = a.Release
+	}
+	return c
+}
+
+func (c *fakeController) GetApp(appID string) (*ct.App, error) {
+	if a, ok := c.apps[appID]; ok {
+		return a, nil
+	}
+	return nil, controller.ErrNotFound
+}
+
+func (c *fakeController) AppList() ([]*ct.App, error) {
+	apps := []*ct.App{}
+	for id := range c.releases {
+		apps = append(apps, c.apps[id])
+	}
+	return apps, nil
+}
+
+func (c *fakeController) GetAppRelease(appID string) (*ct.Release, error) {
+	if r, ok := c.releases[appID]; ok {
+		return r, nil
+	}
+	return nil, controller.ErrNotFound
+}
+
+// newTestAPI serves an API for keys over a repo on the test database and a
+// memStore.  The API is returned so that tests can set anything else they
+// need before making requests, and the server needs closing.
+func newTestAPI(t *testing.T, keys []string) (*API, *httptest.Server) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(&PgBackups{Repo: repo, Store: newMemStore()}, keys)
+	return api, httptest.NewServer(api.Handler())
 }
 
-func newDummyStore() *dummyStore {
-	return &dummyStore{}
+func newMemStore() *memStore {
+	return &memStore{
+		objects:   make(map[string]*StoredBackup),
+		manifests: make(map[string]*Manifest),
+	}
 }
 
-func (*dummyStore) DownloadUrl(string, string) (string, error) {
+func (*memStore) DownloadUrl(string, string) (string, error) {
 	return "", nil
 }
 
-func (*dummyStore) Put(appId string, backupId string, r io.Reader) error {
+func (s *memStore) Put(ctx context.Context, appId string, backupId string, r io.Reader) (int64, error) {
+	n, err := io.Copy(ioutil.Discard, r)
+	s.objects[backupId] = &StoredBackup{AppID: appId, BackupID: backupId, Bytes: n, LastModified: time.Now()}
+	return n, err
+}
+
+func (s *memStore) Get(appId string, backupId string) (io.ReadCloser, error) {
+	if _, ok := s.objects[backupId]; !ok {
+		return nil, fmt.Errorf("no object for %s", backupId)
+	}
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (s *memStore) Delete(appId string, backupId string) error {
+	delete(s.objects, backupId)
+	delete(s.manifests, backupId)
+	return nil
+}
+
+func (s *memStore) List() ([]*StoredBackup, error) {
+	result := []*StoredBackup{}
+	for _, o := range s.objects {
+		result = append(result, o)
+	}
+	return result, nil
+}
+
+func (*memStore) Ping() error {
 	return nil
 }
 
-func (*dummyStore) Delete(appId string, backupId string) error {
+func (*memStore) Locations(appId string, backupId string) []string {
+	return []string{"mem://" + appId + "/" + backupId}
+}
+
+func (s *memStore) PutManifest(m *Manifest) error {
+	s.manifests[m.BackupID] = m
 	return nil
 }
+
+func (s *memStore) GetManifest(appId string, backupId string) (*Manifest, error) {
+	m, ok := s.manifests[backupId]
+	if !ok {
+		return nil, fmt.Errorf("no manifest for %s", backupId)
+	}
+	return m, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricFailures  = "pgbackups_backup_failures_total"
+	metricRetries   = "pgbackups_backup_retries_total"
+	metricUploaded  = "pgbackups_uploaded_bytes_total"
+	metricDeletions = "pgbackups_retention_deletions_total"
+	metricStoreOps  = "pgbackups_store_operation_duration_seconds"
+)
+
+var metricHelp = map[string]string{
+	metricFailures:  "Backups that failed, after any retries.",
+	metricRetries:   "Backup attempts that failed and were retried.",
+	metricUploaded:  "Bytes uploaded to the store, including by attempts that failed.",
+	metricDeletions: "Backups deleted by retention.",
+	metricStoreOps:  "How long store operations took.",
+}
+
+// store operations can take anything from milliseconds for a delete to hours
+// for the upload of a large dump
+var storeOpBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800, 7200}
+
+var counterMetrics = []string{metricFailures, metricRetries, metricUploaded, metricDeletions}
+
+// Metrics counts what workers have done, for the /metrics endpoint.  The
+// counters are per app, by name, and are kept in the database so that they
+// cover every process and survive restarts.  Store operation times are only
+// this process's.  A nil Metrics records nothing, for work run outside of a
+// worker.
+type Metrics struct {
+	repo     *BackupRepo
+	mu       sync.Mutex
+	storeOps map[[2]string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewMetrics(repo *BackupRepo) *Metrics {
+	return &Metrics{
+		repo:     repo,
+		storeOps: make(map[[2]string]*histogram),
+	}
+}
+
+// a counter that can't be added to is logged rather than failing the work
+// it counts
+func (m *Metrics) add(name string, app string, v float64) {
+	if m == nil {
+		return
+	}
+	if err := m.repo.AddToCounter(name, app, v); err != nil {
+		logger.Error("Error adding to counter", "counter", name, "app", app, "err", err)
+	}
+}
+
+func (m *Metrics) BackupFailed(app string) {
+	m.add(metricFailures, app, 1)
+}
+
+func (m *Metrics) BackupRetried(app string) {
+	m.add(metricRetries, app, 1)
+}
+
+func (m *Metrics) Uploaded(app string, bytes int64) {
+	m.add(metricUploaded, app, float64(bytes))
+}
+
+func (m *Metrics) BackupDeleted(app string) {
+	m.add(metricDeletions, app, 1)
+}
+
+func (m *Metrics) ObserveStoreOp(store string, op string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{store, op}
+	h, ok := m.storeOps[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(storeOpBuckets))}
+		m.storeOps[key] = h
+	}
+	seconds := d.Seconds()
+	for i, le := range storeOpBuckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// writeCounterMetrics writes counters, as loaded by Counters, in the
+// Prometheus text format, sorted so that the output is stable
+func writeCounterMetrics(w io.Writer, counters map[string]map[string]float64) {
+	for _, name := range counterMetrics {
+		writeMetricHeader(w, name, "counter")
+		apps := make([]string, 0, len(counters[name]))
+		for app := range counters[name] {
+			apps = append(apps, app)
+		}
+		sort.Strings(apps)
+		for _, app := range apps {
+			writeMetric(w, name, formatLabels("app", app), counters[name][app])
+		}
+	}
+}
+
+// Write writes this process's store operation times in the Prometheus text
+// format
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricHeader(w, metricStoreOps, "histogram")
+	keys := make([][2]string, 0, len(m.storeOps))
+	for key := range m.storeOps {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		h := m.storeOps[key]
+		for i, le := range storeOpBuckets {
+			writeMetric(w, metricStoreOps+"_bucket", formatLabels("store", key[0], "operation", key[1], "le", fmt.Sprint(le)), float64(h.counts[i]))
+		}
+		writeMetric(w, metricStoreOps+"_bucket", formatLabels("store", key[0], "operation", key[1], "le", "+Inf"), float64(h.count))
+		writeMetric(w, metricStoreOps+"_sum", formatLabels("store", key[0], "operation", key[1]), h.sum)
+		writeMetric(w, metricStoreOps+"_count", formatLabels("store", key[0], "operation", key[1]), float64(h.count))
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, metricHelp[name], name, kind)
+}
+
+func writeMetric(w io.Writer, name string, labels string, v float64) {
+	fmt.Fprintf(w, "%s%s %g\n", name, labels, v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats name, value pairs as a label set
+func formatLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// writeLastBackupMetrics writes gauges of each app's last completed backup.
+// These come from the database rather than this process, so they are right
+// whichever worker took the backup.
+func writeLastBackupMetrics(w io.Writer, backups []*Backup) {
+	gauges := []struct {
+		name, help string
+		value      func(*Backup) float64
+	}{
+		{"pgbackups_last_success_timestamp_seconds", "When the app's last completed backup finished.", func(b *Backup) float64 {
+			return float64(b.CompletedAt.UnixNano()) / 1e9
+		}},
+		{"pgbackups_last_duration_seconds", "How long the app's last completed backup took.", func(b *Backup) float64 {
+			return b.CompletedAt.Sub(*b.StartedAt).Seconds()
+		}},
+		{"pgbackups_last_size_bytes", "The size of the app's last completed backup.", func(b *Backup) float64 {
+			return float64(b.Bytes)
+		}},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, b := range backups {
+			if b.StartedAt == nil || b.CompletedAt == nil {
+				continue
+			}
+			writeMetric(w, g.name, formatLabels("app", b.AppName), g.value(b))
+		}
+	}
+}
+
+// instrumentedStore times the operations of the Storer it wraps
+type instrumentedStore struct {
+	Storer
+	name    string
+	metrics *Metrics
+}
+
+func instrumentStore(s Storer, name string, m *Metrics) Storer {
+	return &instrumentedStore{Storer: s, name: name, metrics: m}
+}
+
+func (s *instrumentedStore) observe(op string, start time.Time) {
+	s.metrics.ObserveStoreOp(s.name, op, time.Since(start))
+}
+
+func (s *instrumentedStore) DownloadUrl(appId string, backupId string) (string, error) {
+	defer s.observe("download_url", time.Now())
+	return s.Storer.DownloadUrl(appId, backupId)
+}
+
+func (s *instrumentedStore) Put(ctx context.Context, appId string, backupId string, r io.Reader) (int64, error) {
+	defer s.observe("put", time.Now())
+	return s.Storer.Put(ctx, appId, backupId, r)
+}
+
+// only opening the object is timed, as reading it is up to the caller
+func (s *instrumentedStore) Get(appId string, backupId string) (io.ReadCloser, error) {
+	defer s.observe("get", time.Now())
+	return s.Storer.Get(appId, backupId)
+}
+
+func (s *instrumentedStore) Delete(appId string, backupId string) error {
+	defer s.observe("delete", time.Now())
+	return s.Storer.Delete(appId, backupId)
+}
+
+func (s *instrumentedStore) List() ([]*StoredBackup, error) {
+	defer s.observe("list", time.Now())
+	return s.Storer.List()
+}
+
+func (s *instrumentedStore) PutManifest(m *Manifest) error {
+	defer s.observe("put_manifest", time.Now())
+	return s.Storer.PutManifest(m)
+}
+
+// health checks ping the store every few seconds, which would swamp the
+// times of the operations backups make, so pings aren't timed
+func (s *instrumentedStore) Ping() error {
+	return s.Storer.Ping()
+}
+
+func (s *instrumentedStore) GetManifest(appId string, backupId string) (*Manifest, error) {
+	defer s.observe("get_manifest", time.Now())
+	return s.Storer.GetManifest(appId, backupId)
+}
+
+func (r *BackupRepo) AddToCounter(name string, app string, v float64) error {
+	return r.db.Exec(`
+		INSERT INTO pgbackups_counters (name, app, value) VALUES ($1, $2, $3)
+		ON CONFLICT (name, app) DO UPDATE SET value = pgbackups_counters.value + EXCLUDED.value`,
+		name, app, v)
+}
+
+// Counters returns every counter's value, by name then app
+func (r *BackupRepo) Counters() (map[string]map[string]float64, error) {
+	rows, err := r.db.Query("SELECT name, app, value FROM pgbackups_counters")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counters := make(map[string]map[string]float64)
+	for rows.Next() {
+		var name, app string
+		var value float64
+		if err := rows.Scan(&name, &app, &value); err != nil {
+			return nil, err
+		}
+		if counters[name] == nil {
+			counters[name] = make(map[string]float64)
+		}
+		counters[name][app] = value
+	}
+	return counters, rows.Err()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestMetrics(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// counters are kept in the database, so each run counts for new apps
+	a, b, id := "a"+random.String(8), "b"+random.String(8), random.String(8)
+	m := NewMetrics(repo)
+	m.BackupFailed(b)
+	m.BackupFailed(a)
+	m.BackupFailed(a)
+	m.Uploaded(`quoted"`+id, 2048)
+	m.ObserveStoreOp("backups", "put", 3*time.Second)
+	m.ObserveStoreOp("backups", "put", 20*time.Millisecond)
+
+	// a nil Metrics is safe to record on
+	var none *Metrics
+	none.BackupRetried("a")
+
+	started := time.Unix(1000, 0)
+	completed := started.Add(90 * time.Second)
+	var out bytes.Buffer
+	writeLastBackupMetrics(&out, []*Backup{{AppName: "a", StartedAt: &started, CompletedAt: &completed, Bytes: 512}})
+	counters, err := repo.Counters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCounterMetrics(&out, counters)
+	m.Write(&out)
+
+	for _, line := range []string{
+		`pgbackups_last_success_timestamp_seconds{app="a"} 1090`,
+		`pgbackups_last_duration_seconds{app="a"} 90`,
+		`pgbackups_last_size_bytes{app="a"} 512`,
+		"# TYPE pgbackups_backup_failures_total counter",
+		`pgbackups_backup_failures_total{app="` + a + `"} 2`,
+		`pgbackups_backup_failures_total{app="` + b + `"} 1`,
+		`pgbackups_uploaded_bytes_total{app="quoted\"` + id + `"} 2048`,
+		`pgbackups_store_operation_duration_seconds_bucket{store="backups",operation="put",le="0.05"} 1`,
+		`pgbackups_store_operation_duration_seconds_bucket{store="backups",operation="put",le="5"} 2`,
+		`pgbackups_store_operation_duration_seconds_bucket{store="backups",operation="put",le="+Inf"} 2`,
+		`pgbackups_store_operation_duration_seconds_count{store="backups",operation="put"} 2`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	EventFailed      = "backup.failed"
+	EventSucceeded   = "backup.succeeded"
+	EventRecovered   = "backup.recovered"
+	EventStale       = "backup.stale"
+	EventSizeAnomaly = "backup.size_anomaly"
+	EventDeleted     = "retention.deleted"
+
+	// how often the leader looks for apps whose backups are older than the RPO
+	staleCheckCronLine = "@every 10m"
+	// backups this much bigger or smaller than the last are reported
+	defaultSizeChange = 0.5
+	// how long shutdown waits for notifications still being sent
+	notifyWait = 30 * time.Second
+)
+
+// notifications that fail are retried, as endpoints are often briefly down
+var notifyRetry = RetryPolicy{MaxAttempts: 4, BaseDelay: 2 * time.Second, MaxDelay: time.Minute}
+
+var notifyEvents = []string{EventFailed, EventSucceeded, EventRecovered, EventStale, EventSizeAnomaly, EventDeleted}
+
+// Event is something about an app's backups worth telling people about
+type Event struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	AppID    string    `json:"app_id"`
+	AppName  string    `json:"app_name"`
+	BackupID string    `json:"backup_id,omitempty"`
+	Message  string    `json:"message"`
+	Error    string    `json:"error,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	// the size of the last backup, for size anomalies
+	PreviousBytes int64 `json:"previous_bytes,omitempty"`
+	// when the last successful backup was started, for stale apps
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+}
+
+// Notifier sends events somewhere people will see them
+type Notifier interface {
+	Notify(ctx context.Context, e *Event) error
+}
+
+// NotifyFilter limits a notifier to some apps, by name, and some events.
+// Empty lists allow everything.
+type NotifyFilter struct {
+	Apps   []string `json:"apps"`
+	Events []string `json:"events"`
+}
+
+func (f NotifyFilter) Validate() error {
+	for _, e := range f.Events {
+		if !contains(notifyEvents, e) {
+			return fmt.Errorf("unknown event %q, expected one of %v", e, notifyEvents)
+		}
+	}
+	return nil
+}
+
+func (f NotifyFilter) Allows(e *Event) bool {
+	return (len(f.Apps) == 0 || contains(f.Apps, e.AppName)) &&
+		(len(f.Events) == 0 || contains(f.Events, e.Event))
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+type filteredNotifier struct {
+	Notifier
+	filter NotifyFilter
+}
+
+// notify sends the event to each notifier whose filter allows it, in the
+// background so that backups aren't held up by slow endpoints
+func (pgb *PgBackups) notify(e *Event) {
+	e.Time = time.Now()
+	for _, n := range pgb.Notifiers {
+		if !n.filter.Allows(e) {
+			continue
+		}
+		pgb.notifying.Add(1)
+		go func(n Notifier) {
+			defer pgb.notifying.Done()
+			if err := n.Notify(context.Background(), e); err != nil {
+				logger.Error("Error sending notification", "event", e.Event, "app", e.AppName, "app_id", e.AppID, "backup_id", e.BackupID, "err", err)
+			}
+		}(n.Notifier)
+	}
+}
+
+// retryNotify calls send until it succeeds, fails permanently or runs out of
+// attempts
+func retryNotify(ctx context.Context, policy RetryPolicy, send func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || !isRetryable(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+		select {
+		case <-time.After(policy.Backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitForNotifications returns whether the notifications being sent finished
+// within timeout
+func (pgb *PgBackups) waitForNotifications(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pgb.notifying.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		logger.Warn("Notifications did not finish sending in time")
+		return false
+	}
+}
+
+// AddNotifier sends the events filter allows to n
+func (pgb *PgBackups) AddNotifier(n Notifier, filter NotifyFilter) {
+	pgb.Notifiers = append(pgb.Notifiers, filteredNotifier{Notifier: n, filter: filter})
+}
+
+func (pgb *PgBackups) notifyFailed(b *Backup, cause error) {
+	pgb.notify(&Event{
+		Event:    EventFailed,
+		AppID:    b.AppID,
+		AppName:  b.AppName,
+		BackupID: b.BackupID,
+		Message:  fmt.Sprintf("Backup of %s failed: %s", b.AppName, cause),
+		Error:    cause.Error(),
+	})
+}
+
+// notifyCompleted reports a completed backup, and whether it recovers from a
+// failure or is an unusual size, given the app's backups that finished and
+// completed before it
+func (pgb *PgBackups) notifyCompleted(b *Backup, lastFinished *Backup, lastCompleted *Backup) {
+	pgb.notify(&Event{
+		Event:    EventSucceeded,
+		AppID:    b.AppID,
+		AppName:  b.AppName,
+		BackupID: b.BackupID,
+		Message:  fmt.Sprintf("Backed up %s (%s)", b.AppName, formatBytes(b.Bytes)),
+		Bytes:    b.Bytes,
+	})
+
+	if lastFinished != nil && lastFinished.Status == BackupStatusFailed {
+		pgb.notify(&Event{
+			Event:    EventRecovered,
+			AppID:    b.AppID,
+			AppName:  b.AppName,
+			BackupID: b.BackupID,
+			Message:  fmt.Sprintf("Backups of %s are working again", b.AppName),
+			Bytes:    b.Bytes,
+		})
+	}
+
+	if lastCompleted != nil && sizeChanged(lastCompleted.Bytes, b.Bytes, pgb.SizeChange) {
+		pgb.notify(&Event{
+			Event:         EventSizeAnomaly,
+			AppID:         b.AppID,
+			AppName:       b.AppName,
+			BackupID:      b.BackupID,
+			Message:       fmt.Sprintf("Backup of %s is %s, the last was %s", b.AppName, formatBytes(b.Bytes), formatBytes(lastCompleted.Bytes)),
+			Bytes:         b.Bytes,
+			PreviousBytes: lastCompleted.Bytes,
+		})
+	}
+}
+
+func (pgb *PgBackups) notifyDeleted(b *Backup) {
+	pgb.notify(&Event{
+		Event:    EventDeleted,
+		AppID:    b.AppID,
+		AppName:  b.AppName,
+		BackupID: b.BackupID,
+		Message:  fmt.Sprintf("Deleted backup %s of %s by retention", b.BackupID, b.AppName),
+		Bytes:    b.Bytes,
+	})
+}
+
+// sizeChanged returns whether current differs from previous by more than the
+// fraction threshold of previous, either way.  A threshold of zero or less
+// disables the check.
+func sizeChanged(previous int64, current int64, threshold float64) bool {
+	if threshold <= 0 || previous <= 0 {
+		return false
+	}
+	return math.Abs(float64(current-previous)) > threshold*float64(previous)
+}
+
+// CheckStale reports apps whose last successful backup was started longer
+// than the RPO ago.  Apps that have never been backed up successfully are
+// reported once they were created longer than the RPO ago.
+func (pgb *PgBackups) CheckStale(now time.Time) {
+	if pgb.RPO <= 0 {
+		return
+	}
+	apps, err := pgb.AppsToBackUp()
+	if err != nil {
+		logger.Error("Error obtaining app list", "err", err)
+		return
+	}
+	last, err := pgb.Repo.LastCompletedBackups()
+	if err != nil {
+		logger.Error("Error getting last backups", "err", err)
+		return
+	}
+
+	for _, a := range apps {
+		at, ok := last[a.App.ID]
+		since := at
+		if !ok {
+			if a.App.CreatedAt == nil {
+				continue
+			}
+			since = *a.App.CreatedAt
+		}
+		if now.Sub(since) <= pgb.RPO {
+			continue
+		}
+		first, err := pgb.Repo.ReportStale(a.App.ID, since)
+		if err != nil {
+			logger.Error("Error recording stale backup", "app", a.App.Name, "err", err)
+			continue
+		}
+		if !first {
+			continue
+		}
+		e := &Event{
+			Event:   EventStale,
+			AppID:   a.App.ID,
+			AppName: a.App.Name,
+			Message: fmt.Sprintf("%s has never been backed up, and was created %s ago, longer than the RPO of %s", a.App.Name, now.Sub(since).Truncate(time.Minute), pgb.RPO),
+		}
+		if ok {
+			e.Message = fmt.Sprintf("The last backup of %s was %s ago, longer than the RPO of %s", a.App.Name, now.Sub(at).Truncate(time.Minute), pgb.RPO)
+			e.LastSuccessAt = &at
+		}
+		pgb.notify(e)
+	}
+}
+
+// ReportStale records that the app's backups are stale since lastSuccess,
+// its last successful backup or its creation if it has none, returning
+// whether that hadn't been reported yet.  It's kept in the database so that each stale backup is only
+// reported once, rather than on every check or by every new leader.
+func (r *BackupRepo) ReportStale(appID string, lastSuccess time.Time) (bool, error) {
+	var reported int
+	err := r.db.QueryRow(`
+	WITH reported AS (
+		INSERT INTO pgbackups_stale_reports (app_id, last_success_at) VALUES ($1, $2)
+		ON CONFLICT (app_id) DO UPDATE SET last_success_at = EXCLUDED.last_success_at, reported_at = now()
+		WHERE pgbackups_stale_reports.last_success_at <> EXCLUDED.last_success_at
+		RETURNING app_id
+	)
+	SELECT count(*) FROM reported`, appID, lastSuccess).Scan(&reported)
+	return reported == 1, err
+}
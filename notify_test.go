@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestSizeChanged(t *testing.T) {
+	for _, c := range []struct {
+		previous, current int64
+		threshold         float64
+		changed           bool
+	}{
+		{100, 140, 0.5, false},
+		{100, 151, 0.5, true},
+		{100, 49, 0.5, true},
+		{100, 1000, 0, false},
+		{0, 1000, 0.5, false},
+	} {
+		if changed := sizeChanged(c.previous, c.current, c.threshold); changed != c.changed {
+			t.Errorf("sizeChanged(%d, %d, %g) = %t, expected %t", c.previous, c.current, c.threshold, changed, c.changed)
+		}
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	configs, err := parseWebhooks(`[{"url":"http://a"},{"url":"http://b","format":"slack","apps":["web"],"events":["backup.failed"]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[0].Format != WebhookFormatJSON || configs[1].Format != WebhookFormatSlack {
+		t.Fatalf("unexpected configs: %+v", configs)
+	}
+	f := configs[1].NotifyFilter
+	if !f.Allows(&Event{Event: EventFailed, AppName: "web"}) {
+		t.Error("expected the filter to allow a failure of web")
+	}
+	if f.Allows(&Event{Event: EventFailed, AppName: "api"}) || f.Allows(&Event{Event: EventSucceeded, AppName: "web"}) {
+		t.Error("expected the filter to only allow failures of web")
+	}
+
+	for _, bad := range []string{`{}`, `[{}]`, `[{"url":"http://a","format":"xml"}]`, `[{"url":"http://a","events":["nope"]}]`} {
+		if _, err := parseWebhooks(bad); err == nil {
+			t.Errorf("expected an error parsing %s", bad)
+		}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var requests int32
+	status := http.StatusInternalServerError
+	var body []byte
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	w := newWebhookNotifier(&WebhookConfig{URL: srv.URL, Secret: "secret", Format: WebhookFormatJSON})
+	w.retry = RetryPolicy{MaxAttempts: 3}
+	e := &Event{Event: EventFailed, AppName: "web", Message: "Backup of web failed: boom", Error: "boom"}
+
+	// 5xx responses are retried
+	if err := w.Notify(context.Background(), e); err == nil {
+		t.Fatal("expected an error from a failing webhook")
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+
+	// other 4xx responses aren't
+	atomic.StoreInt32(&requests, 0)
+	status = http.StatusBadRequest
+	if err := w.Notify(context.Background(), e); err == nil {
+		t.Fatal("expected an error from a rejecting webhook")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 attempt, got %d", n)
+	}
+
+	status = http.StatusOK
+	if err := w.Notify(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Pgbackups-Event") != EventFailed {
+		t.Errorf("unexpected event header %q", header.Get("X-Pgbackups-Event"))
+	}
+	timestamp, _ := strconv.ParseInt(header.Get("X-Pgbackups-Timestamp"), 10, 64)
+	if age := time.Since(time.Unix(timestamp, 0)); age < 0 || age > time.Minute {
+		t.Errorf("unexpected timestamp %q", header.Get("X-Pgbackups-Timestamp"))
+	}
+	if sig := header.Get("X-Pgbackups-Signature"); sig != "sha256="+webhookSignature("secret", header.Get("X-Pgbackups-Timestamp"), body) {
+		t.Errorf("unexpected signature %q", sig)
+	}
+	// the timestamp is signed along with the body
+	if webhookSignature("secret", "1", body) == webhookSignature("secret", "2", body) {
+		t.Error("expected the signature to depend on the timestamp")
+	}
+	var got Event
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Event != EventFailed || got.Error != "boom" {
+		t.Errorf("unexpected event %+v", got)
+	}
+
+	w.config.Format = WebhookFormatSlack
+	if err := w.Notify(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	var msg slackMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != e.Message || len(msg.Attachments) != 1 || msg.Attachments[0].Color != "danger" {
+		t.Errorf("unexpected slack message %+v", msg)
+	}
+}
+
+type recordingNotifier chan *Event
+
+func (r recordingNotifier) Notify(ctx context.Context, e *Event) error {
+	r <- e
+	return nil
+}
+
+func TestNotifyCompleted(t *testing.T) {
+	events := make(recordingNotifier, 10)
+	pgb := &PgBackups{SizeChange: 0.5}
+	pgb.AddNotifier(events, NotifyFilter{})
+
+	pgb.notifyCompleted(&Backup{AppName: "web", Bytes: 10}, &Backup{Status: BackupStatusFailed}, &Backup{Bytes: 100})
+	pgb.waitForNotifications(notifyWait)
+	close(events)
+
+	got := make(map[string]bool)
+	for e := range events {
+		got[e.Event] = true
+	}
+	for _, name := range []string{EventSucceeded, EventRecovered, EventSizeAnomaly} {
+		if !got[name] {
+			t.Errorf("expected a %s event", name)
+		}
+	}
+}
+
+func TestReportStale(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appID := random.UUID()
+	last := time.Now().Add(-48 * time.Hour).Truncate(time.Millisecond)
+
+	for _, expected := range []bool{true, false} {
+		if first, err := repo.ReportStale(appID, last); err != nil || first != expected {
+			t.Errorf("expected %t reporting the backup at %s, got %t, %v", expected, last, first, err)
+		}
+	}
+	// backups stale since a later backup are reported again
+	if first, err := repo.ReportStale(appID, last.Add(time.Hour)); err != nil || !first {
+		t.Errorf("expected a later backup to be reported, got %t, %v", first, err)
+	}
+}
+
+func TestCheckStaleNeverBackedUp(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("APPS")
+
+	created := time.Now().Add(-48 * time.Hour).Truncate(time.Millisecond)
+	recent := time.Now()
+	app := func(name string, createdAt *time.Time) *AppAndRelease {
+		return &AppAndRelease{
+			App:     &ct.App{ID: random.UUID(), Name: name, CreatedAt: createdAt},
+			Release: &ct.Release{Env: map[string]string{"FLYNN_POSTGRES": "postgres"}},
+		}
+	}
+	old, young := app("old", &created), app("young", &recent)
+
+	events := make(recordingNotifier, 10)
+	pgb := &PgBackups{Repo: repo, RPO: 26 * time.Hour, FlynnClient: &FlynnClient{client: newFakeController(old, young)}}
+	pgb.AddNotifier(events, NotifyFilter{})
+
+	// only the app created longer than the RPO ago is reported, and only once
+	for i := 0; i < 2; i++ {
+		pgb.CheckStale(time.Now())
+	}
+	pgb.waitForNotifications(notifyWait)
+	close(events)
+
+	var got []*Event
+	for e := range events {
+		got = append(got, e)
+	}
+	if len(got) != 1 || got[0].AppID != old.App.ID || got[0].Event != EventStale || got[0].LastSuccessAt != nil {
+		t.Errorf("expected one stale event for the old app, got %+v", got)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
-	"io"
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/pkg/postgres"
@@ -12,8 +16,54 @@ import (
 
 type PgBackups struct {
 	Store       Storer
+	SelfStore   Storer
 	FlynnClient *FlynnClient
 	Repo        *BackupRepo
+	Retry       RetryPolicy
+	// the longest a backup may take, and the longest it may go without
+	// receiving any data.  zero means no limit.
+	Timeout      time.Duration
+	StallTimeout time.Duration
+
+	// how long leases last without being renewed, see Lease
+	LeaseTTL time.Duration
+
+	// the number of completed deploy backups kept per app
+	DeployRetain int
+
+	// check whether databases have changed before dumping them, see
+	// backupIfChanged
+	SkipUnchanged bool
+
+	// counts what workers do, for the /metrics endpoint
+	Metrics *Metrics
+
+	// where events are sent, see notify
+	Notifiers []filteredNotifier
+	notifying sync.WaitGroup
+	// sends email alerts and the digest, nil without SMTP_HOST
+	Mailer *Mailer
+	// apps are reported stale when their last backup is older than this.
+	// zero disables the check.
+	RPO time.Duration
+	// backups whose size differs from the last by more than this fraction
+	// of it are reported.  zero disables the check.
+	SizeChange float64
+
+	running  runningBackups
+	draining atomic.Bool
+	// RunJobs, which returns once draining and its jobs have finished,
+	// including recording how they went
+	workers sync.WaitGroup
+	// the number of jobs running at once across all workers, in total, per
+	// postgres host and per postgres cluster.  zero means unlimited for the
+	// latter two.
+	Concurrency        int
+	HostConcurrency    int
+	ClusterConcurrency int
+	// the number of catch-up backups running at once across all workers,
+	// see Scheduler.catchUp.  zero means unlimited.
+	CatchupConcurrency int
 }
 
 func NewPgBackups() (*PgBackups, error) {
@@ -23,7 +73,12 @@ func NewPgBackups() (*PgBackups, error) {
 		return nil, err
 	}
 
-	store, err := NewS3Store(os.Getenv("S3_BUCKET"), os.Getenv("AWS_REGION"))
+	store, err := NewS3Store(os.Getenv("S3_BUCKET"), os.Getenv("AWS_REGION"), storePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	selfStore, err := NewS3Store(os.Getenv("S3_BUCKET"), os.Getenv("AWS_REGION"), selfStorePrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -33,76 +88,278 @@ func NewPgBackups() (*PgBackups, error) {
 		return nil, err
 	}
 
-	return &PgBackups{
+	metrics := NewMetrics(backupRepo)
+
+	webhooks, err := parseWebhooks(os.Getenv("WEBHOOKS"))
+	if err != nil {
+		return nil, err
+	}
+
+	mailer, err := mailerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	// only failures are emailed unless asked for more
+	emailFilter := NotifyFilter{Apps: envList("EMAIL_APPS"), Events: envList("EMAIL_EVENTS")}
+	if len(emailFilter.Events) == 0 {
+		emailFilter.Events = []string{EventFailed}
+	}
+	if err := emailFilter.Validate(); err != nil {
+		return nil, fmt.Errorf("error parsing EMAIL_EVENTS: %s", err)
+	}
+
+	pgb := &PgBackups{
 		Repo:        backupRepo,
 		FlynnClient: c,
-		Store:       store,
-	}, nil
-}
+		Store:       instrumentStore(store, "backups", metrics),
+		SelfStore:   instrumentStore(selfStore, "self", metrics),
+		Metrics:     metrics,
+		Mailer:      mailer,
+		Retry:       retryPolicyFromEnv(),
 
-func (pgb *PgBackups) BackupAll() {
-	log.Println("Starting backups")
+		Timeout:      envDuration("BACKUP_TIMEOUT", 6*time.Hour),
+		StallTimeout: envDuration("BACKUP_STALL_TIMEOUT", 10*time.Minute),
+		LeaseTTL:     envDuration("LEASE_TTL", defaultLeaseTTL),
+		DeployRetain: envInt("DEPLOY_BACKUP_RETAIN", defaultDeployRetain),
 
-	apps, err := pgb.FlynnClient.AppList()
+		SkipUnchanged: os.Getenv("SKIP_UNCHANGED") == "true",
+
+		Concurrency:        envInt("BACKUP_CONCURRENCY", 1),
+		HostConcurrency:    envInt("BACKUP_CONCURRENCY_PER_HOST", 0),
+		ClusterConcurrency: envInt("BACKUP_CONCURRENCY_PER_CLUSTER", 0),
+		CatchupConcurrency: envInt("CATCHUP_CONCURRENCY", 1),
+
+		RPO:        envDuration("RPO", 0),
+		SizeChange: envFloat("SIZE_CHANGE_THRESHOLD", defaultSizeChange),
+	}
+	for _, w := range webhooks {
+		pgb.AddNotifier(newWebhookNotifier(w), w.NotifyFilter)
+	}
+	if mailer != nil {
+		pgb.AddNotifier(newEmailNotifier(mailer), emailFilter)
+	}
+	return pgb, nil
+}
+
+// BackupApp backs up the app's database for the job, which is linked to the
+// new backup as soon as it is created
+func (pgb *PgBackups) BackupApp(ctx context.Context, app *AppAndRelease, job *Job) (*Backup, error) {
+	// stops a manual run overlapping a scheduled one, or another worker's
+	ctx, unlock, err := pgb.lockApp(ctx, app.App.ID)
 	if err != nil {
-		log.Printf("Error obtaining app list: %s", err)
-		return
+		return nil, err
 	}
+	defer unlock()
 
-	for _, a := range apps {
-		if shouldBackUpApp(a) {
-			log.Printf("Backing up %s (%s)", a.App.Name, a.App.ID)
-			bytes, err := pgb.BackupApp(a)
-			if err != nil {
-				log.Printf("Error backing up %s (%s): %s", a.App.Name, a.App.ID, err)
-			} else {
-				log.Printf("Completed backing up %s (%s) bytes: %d", a.App.Name, a.App.ID, bytes)
-				pgb.DeleteOldBackups(a)
-			}
+	b := newBackup(app.App.ID, app.App.Name, job.Trigger)
+	b.ReleaseID = app.Release.ID
+	b.DeployReleaseID = job.ReleaseID
+	if err := pgb.Repo.InsertBackup(b); err != nil {
+		return nil, err
+	}
+	bl := b.startLog()
+	log := b.log
+	defer func() {
+		if err := pgb.Repo.SetBackupLog(b, bl.String()); err != nil {
+			logger.Error("Error storing backup log", "backup_id", b.BackupID, "err", err)
 		}
+	}()
+	log.Info("Starting backup", "job_id", job.JobID, "trigger", b.Trigger, "release_id", b.ReleaseID)
+	if err := pgb.Repo.SetJobBackup(job, b.BackupID); err != nil {
+		log.Error("Error linking job to backup", "job_id", job.JobID, "err", err)
+	}
+	setPhase := func(phase string) {
+		job.progress.SetPhase(phase)
+		log.Debug("Starting phase", "phase", phase)
 	}
-}
 
-func (pgb *PgBackups) BackupApp(app *AppAndRelease) (int64, error) {
-	var bytes int64
+	ctx, done := pgb.track(ctx, b.BackupID)
+	defer done()
 
-	// stream stdout from job to store
-	var err error
-	var b *Backup
+	// looked up before this backup finishes, for its notifications
+	lastFinished, lastCompleted := pgb.lastBackups(app.App.ID)
+
+	// the deadline covers the check for changes and every attempt
+	if pgb.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, pgb.Timeout, errBackupTimedOut)
+		defer cancel()
+	}
 
-	b, err = pgb.Repo.NewBackup(app.App.ID)
+	if pgb.SkipUnchanged {
+		setPhase(PhaseChecking)
+		unchanged, err := pgb.checkUnchanged(ctx, app, b)
+		if err != nil {
+			// the backup goes ahead, so this is only logged
+			log.Warn("Error checking for changes", "phase", PhaseChecking, "err", err)
+		}
+		if unchanged {
+			pgb.notifyCompleted(b, lastFinished, nil)
+			return b, nil
+		}
+	}
+
+	var bytes int64
+	var checksum string
+	for attempt := 1; ; attempt++ {
+		startedAt := time.Now()
+		setPhase(PhaseDumping)
+		details := newDumpDetails()
+		bytes, checksum, err = pgb.streamToStore(ctx, app, pgb.Store, b.BackupID, job.progress, details)
+		pgb.Metrics.Uploaded(app.App.Name, bytes)
+		pgb.recordDumpDetails(b, details, err == nil)
+		if rerr := pgb.Repo.RecordAttempt(b, attempt, startedAt, err); rerr != nil {
+			log.Error("Error recording attempt", "attempt", attempt, "err", rerr)
+		}
+		if err == nil {
+			log.Info("Dumped database", "phase", PhaseDumping, "attempt", attempt, "bytes", bytes, "duration", time.Since(startedAt))
+			break
+		}
+		if attempt >= pgb.Retry.MaxAttempts || !isRetryable(err) {
+			pgb.endBackup(b, err)
+			return b, err
+		}
+		delay := pgb.Retry.Backoff(attempt)
+		log.Warn("Attempt failed, retrying", "phase", PhaseDumping, "attempt", attempt, "bytes", bytes, "duration", time.Since(startedAt), "delay", delay, "err", err)
+		setPhase(PhaseRetrying)
+		pgb.Metrics.BackupRetried(app.App.Name)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			err = context.Cause(ctx)
+			pgb.endBackup(b, err)
+			return b, err
+		}
+	}
+
+	err = pgb.Repo.CompleteBackup(b, bytes, checksum)
 	if err != nil {
-		return bytes, err
+		return b, err
 	}
+	log.Info("Completed backup", "bytes", b.Bytes, "duration", b.CompletedAt.Sub(*b.StartedAt))
+	pgb.notifyCompleted(b, lastFinished, lastCompleted)
 
-	r, w := io.Pipe()
+	// the backup itself is complete, so a missing manifest is only logged
+	if err := pgb.Store.PutManifest(newManifest(b)); err != nil {
+		log.Error("Error storing manifest", "err", err)
+	}
 
-	errChan := make(chan error)
+	return b, nil
+}
 
-	go func() {
-		defer w.Close()
+// recordDumpDetails stores what pg_dump wrote to stderr and, for a complete
+// dump, what its header says.  Failing to is only logged.
+func (pgb *PgBackups) recordDumpDetails(b *Backup, details *dumpDetails, complete bool) {
+	log := b.logger()
+	var header *DumpHeader
+	if complete {
 		var err error
-		err = pgb.FlynnClient.StreamBackup(app, w)
-		errChan <- err
-	}()
+		if header, err = details.Header(); err != nil {
+			log.Warn("Error reading dump header", "err", err)
+		}
+	}
+	stderr := details.Stderr()
+	if stderr != "" {
+		log.Warn("pg_dump wrote to stderr", "stderr", stderr)
+	}
+	if err := pgb.Repo.SetDumpDetails(b, header, stderr); err != nil {
+		log.Error("Error recording dump details", "err", err)
+	}
+}
 
-	go func() {
-		defer r.Close()
-		var err error
-		bytes, err = pgb.Store.Put(app.App.ID, b.BackupID, r)
-		errChan <- err
-	}()
+// lastBackups returns the app's last finished and last completed backups,
+// either of which is nil if there isn't one or it can't be found
+func (pgb *PgBackups) lastBackups(appID string) (*Backup, *Backup) {
+	finished, err := pgb.Repo.LastFinishedBackup(appID)
+	if err != nil {
+		logger.Error("Error getting last finished backup", "app_id", appID, "err", err)
+	}
+	completed, err := pgb.Repo.LastCompletedBackup(appID)
+	if err != nil {
+		logger.Error("Error getting last completed backup", "app_id", appID, "err", err)
+	}
+	return finished, completed
+}
 
-	for i := 0; i < 2; i++ {
-		err = <-errChan
-		if err != nil {
-			return bytes, err
-		}
+// a check for changes runs a single short query
+const changeCheckTimeout = time.Minute
+
+var errChangeCheckTimedOut = errors.New("check for changes timed out")
+
+// checkUnchanged reads the app's change marker into b and, if it matches the
+// last completed backup's, records b as unchanged since that backup
+func (pgb *PgBackups) checkUnchanged(ctx context.Context, app *AppAndRelease, b *Backup) (bool, error) {
+	// the stall watchdog only watches dumps, so a hung check is given up on
+	// here rather than holding the app's lease until the backup's deadline
+	checkCtx, cancel := context.WithTimeoutCause(ctx, changeCheckTimeout, errChangeCheckTimedOut)
+	defer cancel()
+	marker, err := pgb.FlynnClient.ChangeMarker(checkCtx, app)
+	if err != nil {
+		return false, err
+	}
+	last, err := pgb.Repo.LastCompletedBackup(app.App.ID)
+	if err != nil {
+		return false, err
+	}
+	if err := pgb.Repo.SetChangeMarker(b, marker); err != nil {
+		return false, err
+	}
+	if marker == "" || last == nil || last.ChangeMarker != marker {
+		return false, nil
 	}
 
-	err = pgb.Repo.CompleteBackup(b, bytes)
+	b.logger().Info("Database is unchanged since the last backup", "same_as", last.BackupID)
+	return true, pgb.Repo.UnchangedBackup(b, last)
+}
 
-	return bytes, err
+// StoredBackupFor returns the backup holding b's data, which is b itself
+// unless b is unchanged since an earlier backup
+func (pgb *PgBackups) StoredBackupFor(b *Backup) (*Backup, error) {
+	if b.SameAs == "" {
+		return b, nil
+	}
+	same, err := pgb.Repo.GetBackup(b.SameAs)
+	if err != nil {
+		return nil, err
+	}
+	if same == nil {
+		return nil, errors.New("backup " + b.SameAs + ", which " + b.BackupID + " is the same as, not found")
+	}
+	return same, nil
+}
+
+// RestoreBackup restores a completed backup into the app's database, which
+// need not be the app it was taken from
+func (pgb *PgBackups) RestoreBackup(ctx context.Context, b *Backup, app *AppAndRelease, progress *jobProgress) error {
+	if b.Status != BackupStatusCompleted {
+		return permanent(errors.New("backup is not completed, it is " + b.Status))
+	}
+
+	r, err := pgb.Store.Get(b.AppID, b.BackupID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	progress.SetPhase(PhaseRestoring)
+	return pgb.FlynnClient.StreamRestore(ctx, app, &progressReader{r: r, progress: progress})
+}
+
+// endBackup records a backup as failed, or cancelled if that's why it ended
+func (pgb *PgBackups) endBackup(b *Backup, cause error) {
+	var err error
+	if cause == errBackupCancelled || cause == errWorkerShutdown {
+		b.logger().Warn("Backup cancelled", "attempts", b.Attempts, "err", cause)
+		err = pgb.Repo.CancelBackup(b, cause)
+	} else {
+		b.logger().Error("Backup failed", "attempts", b.Attempts, "err", cause)
+		pgb.Metrics.BackupFailed(b.AppName)
+		pgb.notifyFailed(b, cause)
+		err = pgb.Repo.FailBackup(b, cause)
+	}
+	if err != nil {
+		b.logger().Error("Error marking backup", "status", b.Status, "err", err)
+	}
 }
 
 func (pgb *PgBackups) DeleteOldBackups(app *AppAndRelease) error {
@@ -110,17 +367,23 @@ func (pgb *PgBackups) DeleteOldBackups(app *AppAndRelease) error {
 	if err != nil {
 		return err
 	}
-	for _, b := range backups {
-		if shouldDeleteBackup(b) {
+	for _, b := range backupsToDelete(backups, pgb.DeployRetain) {
+		// unchanged backups have nothing stored
+		err = nil
+		if b.Status != BackupStatusUnchanged {
 			err = pgb.Store.Delete(b.AppID, b.BackupID)
+		}
+		if err != nil {
+			// just log
+			b.logger().Error("Error deleting stored backup", "err", err)
+		} else {
+			err = pgb.Repo.DeleteBackup(b)
 			if err != nil {
-				// just log
-				log.Printf("Error deleting stored backup: %s", err)
+				b.logger().Error("Error deleting backup", "err", err)
 			} else {
-				err = pgb.Repo.DeleteBackup(b)
-				if err != nil {
-					log.Printf("Error deleting backup: %s", err)
-				}
+				b.logger().Info("Deleted backup by retention", "bytes", b.Bytes)
+				pgb.Metrics.BackupDeleted(b.AppName)
+				pgb.notifyDeleted(b)
 			}
 		}
 	}
@@ -128,6 +391,41 @@ func (pgb *PgBackups) DeleteOldBackups(app *AppAndRelease) error {
 	return nil
 }
 
+// backupsToDelete applies the retention rules to an app's backups, oldest
+// first.  Pinned backups are always kept.  Completed deploy backups are kept
+// by count rather than by date, as they are wanted for rolling back a
+// release however long ago it was, and backups that kept unchanged backups
+// are the same as are always kept.
+func backupsToDelete(backups []*Backup, deployRetain int) []*Backup {
+	deleted := make(map[string]bool)
+	deploys := 0
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		if b.Pinned {
+			deleted[b.BackupID] = false
+		} else if b.Trigger == TriggerDeploy && b.Status == BackupStatusCompleted {
+			deploys++
+			deleted[b.BackupID] = deploys > deployRetain
+		} else {
+			deleted[b.BackupID] = shouldDeleteBackup(b)
+		}
+	}
+
+	for _, b := range backups {
+		if b.SameAs != "" && !deleted[b.BackupID] {
+			deleted[b.SameAs] = false
+		}
+	}
+
+	toDelete := []*Backup{}
+	for _, b := range backups {
+		if deleted[b.BackupID] {
+			toDelete = append(toDelete, b)
+		}
+	}
+	return toDelete
+}
+
 func shouldDeleteBackup(b *Backup) bool {
 	// Keep those that are:
 	// - less than 7 days old (one-a-day for a week)
@@ -140,6 +438,11 @@ func shouldDeleteBackup(b *Backup) bool {
 	d := b.StartedAt
 	now := time.Now()
 
+	// failed backups have nothing stored, so are only kept for a week
+	if b.Status == BackupStatusFailed || b.Status == BackupStatusCancelled {
+		return d.Before(now.Add(-8 * 24 * time.Hour))
+	}
+
 	// work backwards, monthly first
 	if d.Day() == 1 {
 		return false
@@ -155,6 +458,12 @@ func shouldDeleteBackup(b *Backup) bool {
 	return true
 }
 
+// backsUp returns whether app is one that's backed up, as it uses postgres
+// and isn't left out by APPS
+func backsUp(app *AppAndRelease) bool {
+	return app.Release != nil && app.Release.Env["FLYNN_POSTGRES"] != "" && shouldBackUpApp(app)
+}
+
 func shouldBackUpApp(app *AppAndRelease) bool {
 	appsToBackup := strings.Split(os.Getenv("APPS"), ",")
 	if len(appsToBackup) == 0 || (len(appsToBackup) == 1 && appsToBackup[0] == "") {
@@ -167,3 +476,38 @@ func shouldBackUpApp(app *AppAndRelease) bool {
 	}
 	return false
 }
+
+func envInt(name string, defaultValue int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return n
+}
+
+func envFloat(name string, defaultValue float64) float64 {
+	f, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return f
+}
+
+// envList splits a comma separated variable, ignoring empty entries
+func envList(name string) []string {
+	list := []string{}
+	for _, s := range strings.Split(os.Getenv(name), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return d
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PhaseChecking  = "checking"
+	PhaseDumping   = "dumping"
+	PhaseRetrying  = "retrying"
+	PhaseVerifying = "verifying"
+	PhaseRestoring = "restoring"
+	PhasePruning   = "pruning"
+
+	// how often a running job's progress is written for the API to stream
+	progressInterval = 2 * time.Second
+)
+
+// jobProgress counts what a running job has done in its current phase.  It
+// is written to the job's row every progressInterval by the heartbeat.  A
+// nil jobProgress ignores updates, for work run outside of a job.
+type jobProgress struct {
+	mu    sync.Mutex
+	phase string
+	bytes int64
+}
+
+func (p *jobProgress) SetPhase(phase string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phase = phase
+	atomic.StoreInt64(&p.bytes, 0)
+}
+
+func (p *jobProgress) Add(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.bytes, n)
+}
+
+func (p *jobProgress) get() (string, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.phase, atomic.LoadInt64(&p.bytes)
+}
+
+// progressReader counts what is read from r into progress
+type progressReader struct {
+	r        io.Reader
+	progress *jobProgress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.progress.Add(int64(n))
+	return n, err
+}
+
+// progressReporter writes a job's progress when it has changed, working out
+// the throughput since the last write
+type progressReporter struct {
+	job       *Job
+	repo      *BackupRepo
+	lastPhase string
+	lastBytes int64
+	lastAt    time.Time
+}
+
+func (r *progressReporter) report(now time.Time) error {
+	phase, bytes := r.job.progress.get()
+	if phase == r.lastPhase && bytes == r.lastBytes {
+		return nil
+	}
+	var rate int64
+	if phase == r.lastPhase && !r.lastAt.IsZero() {
+		if elapsed := now.Sub(r.lastAt).Seconds(); elapsed > 0 {
+			rate = int64(float64(bytes-r.lastBytes) / elapsed)
+		}
+	}
+	if err := r.repo.UpdateJobProgress(r.job, phase, bytes, rate); err != nil {
+		return err
+	}
+	r.lastPhase, r.lastBytes, r.lastAt = phase, bytes, now
+	return nil
+}
+
+func (r *BackupRepo) UpdateJobProgress(j *Job, phase string, bytes int64, rate int64) error {
+	return r.db.Exec(`
+	UPDATE pgbackups_jobs SET phase = $1, progress_bytes = $2, bytes_per_second = $3, progress_at = now()
+	WHERE job_id = $4 AND worker_id = $5 AND status = 'running'`, phase, bytes, rate, j.JobID, j.WorkerID)
+}
+
+// JobProgress is a running job as streamed by the API, with the name of its
+// app and, where it can be told, how many bytes the job should get through:
+// the size of the app's last backup for backups, or of the backup being
+// restored or verified
+type JobProgress struct {
+	*Job
+	AppName       string `json:"app_name,omitempty"`
+	ExpectedBytes int64  `json:"expected_bytes,omitempty"`
+}
+
+// RunningJobs returns the running jobs, longest running first
+func (r *BackupRepo) RunningJobs() ([]*JobProgress, error) {
+	rows, err := r.db.Query(`
+	SELECT ` + jobColumns + `,
+		(SELECT b.app_name FROM pgbackups b WHERE b.app_id = pgbackups_jobs.app_id ORDER BY b.started_at DESC LIMIT 1),
+		CASE WHEN kind = 'backup'
+		THEN (SELECT l.bytes FROM pgbackups l WHERE l.app_id = pgbackups_jobs.app_id AND l.status = 'completed' ORDER BY l.completed_at DESC LIMIT 1)
+		ELSE (SELECT v.bytes FROM pgbackups v WHERE v.backup_id = pgbackups_jobs.backup_id)
+		END
+	FROM pgbackups_jobs WHERE status = 'running' ORDER BY started_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*JobProgress{}
+	for rows.Next() {
+		var appName *string
+		var expected *int64
+		j, err := scanJob(rows, &appName, &expected)
+		if err != nil {
+			return nil, err
+		}
+		p := &JobProgress{Job: j, AppName: nullString(appName)}
+		if expected != nil {
+			p.ExpectedBytes = *expected
+		}
+		jobs = append(jobs, p)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestProgress(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups_jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a previous backup of the app gives the expected size
+	appID := random.UUID()
+	last, err := repo.NewBackup(appID, "progress-app", TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.DeleteBackup(last)
+	if err := repo.CompleteBackup(last, 1000, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.EnqueueJob(&Job{Kind: JobKindBackup, AppID: appID}); err != nil {
+		t.Fatal(err)
+	}
+	j, err := repo.ClaimJob("a", ClaimLimits{})
+	if err != nil || j == nil {
+		t.Fatalf("expected to claim the job, got %+v %v", j, err)
+	}
+	j.progress = &jobProgress{}
+	reporter := &progressReporter{job: j, repo: repo}
+
+	now := time.Now()
+	j.progress.SetPhase(PhaseDumping)
+	j.progress.Add(100)
+	if err := reporter.report(now); err != nil {
+		t.Fatal(err)
+	}
+	j.progress.Add(400)
+	if err := reporter.report(now.Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, srv := newTestAPI(t, []string{"key"})
+	defer srv.Close()
+
+	var running []*JobProgress
+	err = NewClient(srv.URL, "key").Progress(func(jobs []*JobProgress) bool {
+		running = jobs
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(running) != 1 {
+		t.Fatalf("expected 1 running job, got %d", len(running))
+	}
+	p := running[0]
+	if p.JobID != j.JobID || p.Phase != PhaseDumping || p.ProgressBytes != 500 || p.BytesPerSecond != 200 {
+		t.Errorf("unexpected progress %+v", p.Job)
+	}
+	if p.AppName != "progress-app" || p.ExpectedBytes != 1000 {
+		t.Errorf("expected progress-app of 1000 bytes, got %s of %d", p.AppName, p.ExpectedBytes)
+	}
+
+	// a new phase starts counting again
+	j.progress.SetPhase(PhasePruning)
+	if phase, bytes := j.progress.get(); phase != PhasePruning || bytes != 0 {
+		t.Errorf("expected nothing counted for pruning, got %s %d", phase, bytes)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// Job is a unit of work in the queue, claimed and run by one worker
+type Job struct {
+	JobID string `json:"job_id"`
+	Kind  string `json:"kind"`
+	// the app backed up or restored into, and the backup created, restored
+	// or verified
+	AppID    string `json:"app_id,omitempty"`
+	BackupID string `json:"backup_id,omitempty"`
+	Trigger  string `json:"trigger"`
+	// the release being deployed, for deploy triggered backups
+	ReleaseID string `json:"release_id,omitempty"`
+	// the postgres host and cluster the job connects to, for the
+	// concurrency limits
+	PgHost      string     `json:"pg_host,omitempty"`
+	PgCluster   string     `json:"pg_cluster,omitempty"`
+	Status      string     `json:"status"`
+	RunAt       *time.Time `json:"run_at"`
+	WorkerID    string     `json:"worker_id,omitempty"`
+	HeartbeatAt *time.Time `json:"heartbeat_at,omitempty"`
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   *time.Time `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	// what the job is doing while it runs, and how many bytes it has
+	// streamed doing it, as last written by its worker
+	Phase          string     `json:"phase,omitempty"`
+	ProgressBytes  int64      `json:"progress_bytes"`
+	BytesPerSecond int64      `json:"bytes_per_second"`
+	ProgressAt     *time.Time `json:"progress_at,omitempty"`
+
+	// only set on the worker running the job
+	progress *jobProgress
+}
+
+const (
+	JobKindBackup     = "backup"
+	JobKindSelfBackup = "self_backup"
+	JobKindRestore    = "restore"
+	JobKindVerify     = "verify"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+const (
+	jobPollInterval      = 5 * time.Second
+	jobHeartbeatInterval = 30 * time.Second
+	// running jobs not heartbeated for this long are given back, as their
+	// worker is assumed dead
+	jobStaleAfter = 5 * time.Minute
+	// the number of workers a job is given to before it is failed
+	maxJobAttempts = 3
+	// how long jobs for apps already being backed up wait to run again
+	lockedJobDelay = time.Minute
+)
+
+var (
+	errJobStale = errors.New("worker stopped heartbeating")
+	errJobLost  = permanent(errors.New("job was given back to the queue"))
+)
+
+const jobColumns = "job_id, kind, app_id, backup_id, trigger, pg_host, pg_cluster, status, run_at, worker_id, heartbeat_at, attempts, error, created_at, started_at, finished_at, release_id, phase, progress_bytes, bytes_per_second, progress_at"
+
+// errNotCompleted is returned when asked to use a backup with nothing stored.
+// It is a JSONError so that the API reports it as such.
+func errNotCompleted(b *Backup) error {
+	return httphelper.PreconditionFailedErr("backup is not completed, it is " + b.Status)
+}
+
+func newAppJob(kind string, app *AppAndRelease, trigger string) *Job {
+	return &Job{
+		Kind:      kind,
+		AppID:     app.App.ID,
+		Trigger:   trigger,
+		PgHost:    app.Release.Env["PGHOST"],
+		PgCluster: app.Release.Env["FLYNN_POSTGRES"],
+	}
+}
+
+// EnqueueBackups queues a backup of every app to be backed up, or only the
+// named app if one is given
+func (pgb *PgBackups) EnqueueBackups(trigger string, appName string) ([]*Job, error) {
+	var apps []*AppAndRelease
+	if appName != "" {
+		a, err := pgb.FlynnClient.GetAppAndRelease(appName)
+		if err != nil {
+			return nil, err
+		}
+		// only apps that would be backed up on schedule can be backed up
+		// on demand
+		if !backsUp(a) {
+			return nil, httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("%s is not backed up, as it doesn't use postgres or isn't in APPS", a.App.Name),
+			}
+		}
+		apps = append(apps, a)
+	} else {
+		var err error
+		if apps, err = pgb.AppsToBackUp(); err != nil {
+			return nil, err
+		}
+	}
+
+	jobs := []*Job{}
+	for _, a := range apps {
+		j := newAppJob(JobKindBackup, a, trigger)
+		if err := pgb.Repo.EnqueueJob(j); err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// AppsToBackUp returns the apps using postgres, limited to those in APPS if
+// it is set
+func (pgb *PgBackups) AppsToBackUp() ([]*AppAndRelease, error) {
+	all, err := pgb.FlynnClient.AppList()
+	if err != nil {
+		return nil, err
+	}
+	apps := []*AppAndRelease{}
+	for _, a := range all {
+		if shouldBackUpApp(a) {
+			apps = append(apps, a)
+		}
+	}
+	return apps, nil
+}
+
+func (pgb *PgBackups) EnqueueSelfBackup(trigger string) (*Job, error) {
+	app, err := pgb.selfApp()
+	if err != nil {
+		return nil, err
+	}
+	j := newAppJob(JobKindSelfBackup, app, trigger)
+	return j, pgb.Repo.EnqueueJob(j)
+}
+
+// EnqueueRestore queues a restore of the backup into the named app, or the
+// app it was taken from if no name is given
+func (pgb *PgBackups) EnqueueRestore(b *Backup, appName string) (*Job, error) {
+	b, err := pgb.StoredBackupFor(b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status != BackupStatusCompleted {
+		return nil, errNotCompleted(b)
+	}
+	if appName == "" {
+		appName = b.AppID
+	}
+	app, err := pgb.FlynnClient.GetAppAndRelease(appName)
+	if err != nil {
+		return nil, err
+	}
+	j := newAppJob(JobKindRestore, app, TriggerManual)
+	j.BackupID = b.BackupID
+	return j, pgb.Repo.EnqueueJob(j)
+}
+
+func (pgb *PgBackups) EnqueueVerify(b *Backup) (*Job, error) {
+	b, err := pgb.StoredBackupFor(b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status != BackupStatusCompleted {
+		return nil, errNotCompleted(b)
+	}
+	j := &Job{Kind: JobKindVerify, AppID: b.AppID, BackupID: b.BackupID, Trigger: TriggerManual}
+	return j, pgb.Repo.EnqueueJob(j)
+}
+
+// RunJobs claims and runs jobs from the queue, as many at once as the
+// concurrency allows, until ctx is done or the worker is draining.  Each
+// worker runs up to Concurrency jobs, but ClaimJob keeps the total across
+// all workers within it too.
+func (pgb *PgBackups) RunJobs(ctx context.Context, workerID string) {
+	pgb.workers.Add(1)
+	defer pgb.workers.Done()
+
+	concurrency := pgb.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pgb.claimJobs(ctx, workerID, false)
+		}()
+	}
+	// deploy backups have to be taken before the deploy's migrations run, so
+	// one more slot is kept for them rather than them waiting for a free one
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pgb.claimJobs(ctx, workerID, true)
+	}()
+	wg.Wait()
+}
+
+func (pgb *PgBackups) claimJobs(ctx context.Context, workerID string, deployOnly bool) {
+	for !pgb.Draining() && ctx.Err() == nil {
+		job, err := pgb.Repo.ClaimJob(workerID, pgb.claimLimits(deployOnly))
+		if err != nil {
+			logger.Error("Error claiming job", "err", err)
+		}
+		if job != nil {
+			deferred, err := pgb.deferForBlackout(job)
+			if err != nil {
+				job.logger().Error("Error checking blackouts", "err", err)
+			}
+			if deferred {
+				job.logger().Info("Deferred job in a blackout", "run_at", job.RunAt)
+			} else {
+				pgb.runJob(ctx, job)
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+func (pgb *PgBackups) claimLimits(deployOnly bool) ClaimLimits {
+	return ClaimLimits{
+		Total:      pgb.Concurrency,
+		Host:       pgb.HostConcurrency,
+		Cluster:    pgb.ClusterConcurrency,
+		Catchup:    pgb.CatchupConcurrency,
+		DeployOnly: deployOnly,
+	}
+}
+
+func (pgb *PgBackups) runJob(ctx context.Context, job *Job) {
+	log := job.logger()
+	log.Info("Running job")
+	startedAt := time.Now()
+
+	job.progress = &jobProgress{}
+	ctx, cancel := context.WithCancelCause(ctx)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		pgb.heartbeat(ctx, cancel, job)
+		close(heartbeatDone)
+	}()
+
+	err := pgb.executeJob(ctx, job)
+	cancel(nil)
+	<-heartbeatDone
+
+	switch {
+	case errors.Is(err, errJobLost):
+		log.Warn("Job was given back to the queue while running")
+		return
+	case errors.Is(err, errAppLocked):
+		// the job still runs once the other backup has finished
+		runAt := time.Now().Add(lockedJobDelay)
+		log.Info("Deferring job, the app is already being backed up", "run_at", runAt)
+		err = pgb.Repo.DeferJob(job, runAt)
+	case errors.Is(err, errWorkerShutdown):
+		// another worker picks it up.  this runs before the claim loop, and
+		// so RunJobs, returns, so Drain waits for it before the process
+		// exits rather than the job waiting to be reaped.
+		log.Info("Returning job to the queue, shutting down")
+		err = pgb.Repo.RequeueJob(job)
+	case err != nil:
+		log.Error("Error running job", "duration", time.Since(startedAt), "err", err)
+		err = pgb.Repo.FinishJob(job, err)
+	default:
+		log.Info("Completed job", "duration", time.Since(startedAt))
+		err = pgb.Repo.FinishJob(job, nil)
+	}
+	if err != nil {
+		log.Error("Error updating job", "err", err)
+	}
+}
+
+func (pgb *PgBackups) executeJob(ctx context.Context, job *Job) error {
+	switch job.Kind {
+	case JobKindBackup:
+		app, err := pgb.FlynnClient.GetAppAndRelease(job.AppID)
+		if err != nil {
+			return err
+		}
+		if _, err := pgb.BackupApp(ctx, app, job); err != nil {
+			return err
+		}
+		job.progress.SetPhase(PhasePruning)
+		return pgb.DeleteOldBackups(app)
+	case JobKindSelfBackup:
+		return pgb.BackupSelfAndPrune(ctx, job.progress)
+	case JobKindRestore, JobKindVerify:
+		b, err := pgb.Repo.GetBackup(job.BackupID)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			return errors.New("backup not found")
+		}
+		ctx, done := pgb.track(ctx, job.JobID)
+		defer done()
+		if job.Kind == JobKindVerify {
+			return pgb.VerifyBackup(ctx, b, job.progress)
+		}
+		app, err := pgb.FlynnClient.GetAppAndRelease(job.AppID)
+		if err != nil {
+			return err
+		}
+		return pgb.RestoreBackup(ctx, b, app, job.progress)
+	}
+	return errors.New("unknown job kind " + job.Kind)
+}
+
+// heartbeat marks the job as alive until ctx is done, cancelling it if it
+// has been given to another worker in the meantime.  It also writes the
+// job's progress as it changes.
+func (pgb *PgBackups) heartbeat(ctx context.Context, cancel context.CancelCauseFunc, job *Job) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+	progressTicker := time.NewTicker(progressInterval)
+	defer progressTicker.Stop()
+	reporter := &progressReporter{job: job, repo: pgb.Repo}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-progressTicker.C:
+			if err := reporter.report(now); err != nil {
+				job.logger().Error("Error updating job progress", "err", err)
+			}
+		case <-ticker.C:
+			held, err := pgb.Repo.HeartbeatJob(job)
+			if err != nil {
+				job.logger().Error("Error heartbeating job", "err", err)
+			} else if !held {
+				cancel(errJobLost)
+				return
+			}
+		}
+	}
+}
+
+// WaitForJob polls until the job has finished
+func (pgb *PgBackups) WaitForJob(jobID string) (*Job, error) {
+	for {
+		j, err := pgb.Repo.GetJob(jobID)
+		if err != nil {
+			return nil, err
+		}
+		if j == nil {
+			return nil, errors.New("job not found")
+		}
+		if j.Status == JobStatusSucceeded || j.Status == JobStatusFailed {
+			return j, nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// ReapStaleJobs gives back jobs whose worker has died
+func (pgb *PgBackups) ReapStaleJobs() {
+	n, err := pgb.Repo.RequeueStaleJobs(jobStaleAfter, maxJobAttempts)
+	if err != nil {
+		logger.Error("Error requeueing stale jobs", "err", err)
+	} else if n > 0 {
+		logger.Info("Gave back stale jobs", "count", n)
+	}
+}
+
+func (r *BackupRepo) EnqueueJob(j *Job) error {
+	now := time.Now()
+	j.JobID = random.UUID()
+	j.Status = JobStatusQueued
+	j.CreatedAt = &now
+	if j.RunAt == nil {
+		j.RunAt = &now
+	}
+	if j.Trigger == "" {
+		j.Trigger = TriggerManual
+	}
+	return r.db.Exec("INSERT INTO pgbackups_jobs (job_id, kind, app_id, backup_id, trigger, pg_host, pg_cluster, status, run_at, created_at, release_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		j.JobID, j.Kind, nullUUID(j.AppID), nullUUID(j.BackupID), j.Trigger, j.PgHost, j.PgCluster, j.Status, j.RunAt, j.CreatedAt, j.ReleaseID)
+}
+
+// ClaimLimits bound the number of jobs running across all workers.  Zero
+// means unlimited.
+type ClaimLimits struct {
+	// every job, other than deploy backups
+	Total int
+	// per postgres host and per postgres cluster
+	Host    int
+	Cluster int
+	// catch-up backups, in total
+	Catchup int
+	// only claim deploy backups, for the slot kept for them
+	DeployOnly bool
+}
+
+// ClaimJob takes the next job that is due, returning nil if there are none.
+// Locked rows are skipped, so concurrent claims never get the same job.  The
+// limits are checked against jobs already running, so claims made at the
+// same moment can briefly exceed them.  Deploy backups are claimed before
+// any other job, and aren't held back by the total, host and cluster limits.
+func (r *BackupRepo) ClaimJob(workerID string, limits ClaimLimits) (*Job, error) {
+	rows, err := r.db.Query(`
+	UPDATE pgbackups_jobs SET status = 'running', worker_id = $1, started_at = now(), heartbeat_at = now(), attempts = attempts + 1,
+		phase = '', progress_bytes = 0, bytes_per_second = 0, progress_at = NULL
+	WHERE job_id = (
+		SELECT j.job_id FROM pgbackups_jobs j
+		WHERE j.status = 'queued' AND j.run_at <= now()
+		AND (NOT $6 OR j.trigger = $7)
+		AND ($8 <= 0 OR j.trigger = $7 OR (SELECT count(*) FROM pgbackups_jobs r WHERE r.status = 'running' AND r.trigger <> $7) < $8)
+		AND ($2 <= 0 OR j.pg_host = '' OR j.trigger = $7 OR (SELECT count(*) FROM pgbackups_jobs h WHERE h.status = 'running' AND h.pg_host = j.pg_host) < $2)
+		AND ($3 <= 0 OR j.pg_cluster = '' OR j.trigger = $7 OR (SELECT count(*) FROM pgbackups_jobs c WHERE c.status = 'running' AND c.pg_cluster = j.pg_cluster) < $3)
+		AND ($4 <= 0 OR j.trigger <> $5 OR (SELECT count(*) FROM pgbackups_jobs k WHERE k.status = 'running' AND k.trigger = $5) < $4)
+		ORDER BY j.trigger = $7 DESC, j.run_at, j.created_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING `+jobColumns, workerID, limits.Host, limits.Cluster, limits.Catchup, TriggerCatchup, limits.DeployOnly, TriggerDeploy, limits.Total)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var job *Job
+	for rows.Next() {
+		if job, err = scanJob(rows); err != nil {
+			return nil, err
+		}
+	}
+	return job, rows.Err()
+}
+
+// HeartbeatJob returns whether the job is still held by its worker
+func (r *BackupRepo) HeartbeatJob(j *Job) (bool, error) {
+	var updated int
+	err := r.db.QueryRow(`
+	WITH updated AS (
+		UPDATE pgbackups_jobs SET heartbeat_at = now()
+		WHERE job_id = $1 AND worker_id = $2 AND status = 'running'
+		RETURNING job_id
+	)
+	SELECT count(*) FROM updated`, j.JobID, j.WorkerID).Scan(&updated)
+	return updated == 1, err
+}
+
+func (r *BackupRepo) SetJobBackup(j *Job, backupID string) error {
+	j.BackupID = backupID
+	return r.db.Exec("UPDATE pgbackups_jobs SET backup_id = $1 WHERE job_id = $2", j.BackupID, j.JobID)
+}
+
+// FinishJob records the outcome of a job, with a nil cause for success
+func (r *BackupRepo) FinishJob(j *Job, cause error) error {
+	now := time.Now()
+	j.FinishedAt = &now
+	j.Status = JobStatusSucceeded
+	j.Error = ""
+	if cause != nil {
+		j.Status = JobStatusFailed
+		j.Error = cause.Error()
+	}
+	return r.db.Exec("UPDATE pgbackups_jobs SET status = $1, error = $2, finished_at = $3 WHERE job_id = $4 AND worker_id = $5",
+		j.Status, j.Error, j.FinishedAt, j.JobID, j.WorkerID)
+}
+
+// RequeueJob gives a job back without counting it as an attempt
+func (r *BackupRepo) RequeueJob(j *Job) error {
+	j.Status = JobStatusQueued
+	return r.db.Exec("UPDATE pgbackups_jobs SET status = $1, worker_id = NULL, attempts = attempts - 1 WHERE job_id = $2 AND worker_id = $3",
+		j.Status, j.JobID, j.WorkerID)
+}
+
+// DeferJob gives a job back to run at runAt, without counting it as an attempt
+func (r *BackupRepo) DeferJob(j *Job, runAt time.Time) error {
+	j.Status = JobStatusQueued
+	j.RunAt = &runAt
+	return r.db.Exec("UPDATE pgbackups_jobs SET status = $1, worker_id = NULL, run_at = $2, attempts = attempts - 1 WHERE job_id = $3 AND worker_id = $4",
+		j.Status, j.RunAt, j.JobID, j.WorkerID)
+}
+
+// RequeueStaleJobs gives back running jobs that haven't been heartbeated
+// within staleAfter, failing those given out maxAttempts times already, and
+// returns the number requeued.  Backups the jobs were running are failed, as
+// nothing is left running them.
+func (r *BackupRepo) RequeueStaleJobs(staleAfter time.Duration, maxAttempts int) (int, error) {
+	stale := int64(staleAfter / time.Millisecond)
+	err := r.db.Exec(`
+	UPDATE pgbackups SET status = $1, error = $2
+	WHERE status = $3 AND backup_id IN (
+		SELECT backup_id FROM pgbackups_jobs
+		WHERE kind = 'backup' AND status = 'running' AND heartbeat_at < now() - $4 * interval '1 millisecond'
+	)`, BackupStatusFailed, errJobStale.Error(), BackupStatusRunning, stale)
+	if err != nil {
+		return 0, err
+	}
+
+	var requeued int
+	err = r.db.QueryRow(`
+	WITH given_back AS (
+		UPDATE pgbackups_jobs SET
+			status = CASE WHEN attempts < $1 THEN 'queued' ELSE 'failed' END,
+			finished_at = CASE WHEN attempts < $1 THEN NULL ELSE now() END,
+			error = $2,
+			worker_id = NULL
+		WHERE status = 'running' AND heartbeat_at < now() - $3 * interval '1 millisecond'
+		RETURNING status
+	)
+	SELECT count(*) FROM given_back WHERE status = 'queued'`, maxAttempts, errJobStale.Error(), stale).Scan(&requeued)
+	return requeued, err
+}
+
+// PendingJobApps returns the ids of apps with jobs of the kind queued or
+// running
+func (r *BackupRepo) PendingJobApps(kind string) (map[string]bool, error) {
+	rows, err := r.db.Query("SELECT DISTINCT app_id FROM pgbackups_jobs WHERE kind = $1 AND status IN ('queued', 'running') AND app_id IS NOT NULL", kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	apps := make(map[string]bool)
+	for rows.Next() {
+		var appID string
+		if err := rows.Scan(&appID); err != nil {
+			return nil, err
+		}
+		apps[appID] = true
+	}
+	return apps, rows.Err()
+}
+
+func (r *BackupRepo) GetJob(jobID string) (*Job, error) {
+	jobs, err := r.queryJobs("SELECT "+jobColumns+" FROM pgbackups_jobs WHERE job_id = $1", jobID)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return jobs[0], nil
+}
+
+// GetJobs returns the most recently created jobs, newest first
+func (r *BackupRepo) GetJobs(limit int) ([]*Job, error) {
+	return r.queryJobs("SELECT "+jobColumns+" FROM pgbackups_jobs ORDER BY created_at DESC LIMIT $1", limit)
+}
+
+func (r *BackupRepo) queryJobs(query string, args ...interface{}) ([]*Job, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// scanJob scans the jobColumns, followed by any extra columns into extra
+func scanJob(s postgres.Scanner, extra ...interface{}) (*Job, error) {
+	j := &Job{}
+	var appID, backupID, workerID *string
+	dest := []interface{}{&j.JobID, &j.Kind, &appID, &backupID, &j.Trigger, &j.PgHost, &j.PgCluster, &j.Status, &j.RunAt, &workerID, &j.HeartbeatAt, &j.Attempts, &j.Error, &j.CreatedAt, &j.StartedAt, &j.FinishedAt, &j.ReleaseID, &j.Phase, &j.ProgressBytes, &j.BytesPerSecond, &j.ProgressAt}
+	err := s.Scan(append(dest, extra...)...)
+	j.AppID = nullString(appID)
+	j.BackupID = nullString(backupID)
+	j.WorkerID = nullString(workerID)
+	return j, err
+}
+
+// nullUUID stores empty ids as NULL, as they aren't valid uuids
+func nullUUID(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestQueue(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups_jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	earlier := past.Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	first := &Job{Kind: JobKindBackup, AppID: random.UUID(), PgCluster: "pg", RunAt: &earlier}
+	second := &Job{Kind: JobKindBackup, AppID: random.UUID(), PgCluster: "pg", RunAt: &past}
+	later := &Job{Kind: JobKindBackup, AppID: random.UUID(), RunAt: &future}
+	for _, j := range []*Job{second, first, later} {
+		if err := repo.EnqueueJob(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// jobs are claimed in run_at order, one worker each
+	a, err := repo.ClaimJob("a", ClaimLimits{Cluster: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == nil || a.JobID != first.JobID || a.WorkerID != "a" || a.Attempts != 1 {
+		t.Fatalf("expected a to claim the first job, got %+v", a)
+	}
+
+	// the other job is on a cluster already at its limit
+	if b, err := repo.ClaimJob("b", ClaimLimits{Cluster: 1}); err != nil || b != nil {
+		t.Fatalf("expected b to claim nothing, got %+v %v", b, err)
+	}
+	b, err := repo.ClaimJob("b", ClaimLimits{Cluster: 2})
+	if err != nil || b == nil || b.JobID != second.JobID {
+		t.Fatalf("expected b to claim the second job, got %+v %v", b, err)
+	}
+
+	// the remaining job isn't due
+	if c, err := repo.ClaimJob("c", ClaimLimits{}); err != nil || c != nil {
+		t.Fatalf("expected c to claim nothing, got %+v %v", c, err)
+	}
+
+	if err := repo.FinishJob(a, nil); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := repo.GetJob(a.JobID); j == nil || j.Status != JobStatusSucceeded {
+		t.Errorf("expected the first job to have succeeded, got %+v", j)
+	}
+
+	// b stops heartbeating, so its job is given back
+	if n, err := repo.RequeueStaleJobs(time.Hour, maxJobAttempts); err != nil || n != 0 {
+		t.Fatalf("expected nothing to be requeued yet, got %d %v", n, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, err := repo.RequeueStaleJobs(50*time.Millisecond, maxJobAttempts); err != nil || n != 1 {
+		t.Fatalf("expected 1 job to be requeued, got %d %v", n, err)
+	}
+	if held, err := repo.HeartbeatJob(b); err != nil || held {
+		t.Errorf("expected b to have lost its job, got %t %v", held, err)
+	}
+	c, err := repo.ClaimJob("c", ClaimLimits{})
+	if err != nil || c == nil || c.JobID != second.JobID || c.Attempts != 2 {
+		t.Fatalf("expected c to claim the requeued job, got %+v %v", c, err)
+	}
+	if held, err := repo.HeartbeatJob(c); err != nil || !held {
+		t.Errorf("expected c to hold its job, got %t %v", held, err)
+	}
+
+	// jobs out of attempts are failed rather than requeued
+	time.Sleep(100 * time.Millisecond)
+	if n, err := repo.RequeueStaleJobs(50*time.Millisecond, 2); err != nil || n != 0 {
+		t.Fatalf("expected nothing to be requeued, got %d %v", n, err)
+	}
+	if j, _ := repo.GetJob(c.JobID); j == nil || j.Status != JobStatusFailed || j.Error != errJobStale.Error() {
+		t.Errorf("expected the job to have failed, got %+v", j)
+	}
+}
+
+func TestClaimCatchupLimit(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups_jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := repo.EnqueueJob(&Job{Kind: JobKindBackup, AppID: random.UUID(), Trigger: TriggerCatchup}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limits := ClaimLimits{Catchup: 1}
+	if j, err := repo.ClaimJob("a", limits); err != nil || j == nil {
+		t.Fatalf("expected a to claim a catch-up job, got %+v %v", j, err)
+	}
+	if j, err := repo.ClaimJob("b", limits); err != nil || j != nil {
+		t.Fatalf("expected b to claim nothing, got %+v %v", j, err)
+	}
+	if j, err := repo.ClaimJob("b", ClaimLimits{}); err != nil || j == nil {
+		t.Fatalf("expected b to claim a catch-up job without a limit, got %+v %v", j, err)
+	}
+}
+
+func TestClaimTotalLimit(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups_jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := repo.EnqueueJob(&Job{Kind: JobKindBackup, AppID: random.UUID()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.EnqueueJob(&Job{Kind: JobKindBackup, AppID: random.UUID(), Trigger: TriggerDeploy}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit is shared by every worker, but deploy backups don't count
+	limits := ClaimLimits{Total: 1}
+	if j, err := repo.ClaimJob("a", limits); err != nil || j == nil || j.Trigger != TriggerDeploy {
+		t.Fatalf("expected a to claim the deploy job, got %+v %v", j, err)
+	}
+	if j, err := repo.ClaimJob("a", limits); err != nil || j == nil {
+		t.Fatalf("expected a to claim a job, got %+v %v", j, err)
+	}
+	if j, err := repo.ClaimJob("b", limits); err != nil || j != nil {
+		t.Fatalf("expected b to claim nothing, got %+v %v", j, err)
+	}
+	if j, err := repo.ClaimJob("b", ClaimLimits{Total: 2}); err != nil || j == nil {
+		t.Fatalf("expected b to claim a job, got %+v %v", j, err)
+	}
+}
+
+func TestClaimDeployFirst(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups_jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	earlier := time.Now().Add(-time.Hour)
+	running := &Job{Kind: JobKindBackup, AppID: random.UUID(), Trigger: TriggerSchedule, PgCluster: "pg", RunAt: &earlier}
+	scheduled := &Job{Kind: JobKindBackup, AppID: random.UUID(), Trigger: TriggerSchedule, PgCluster: "pg", RunAt: &earlier}
+	deploy := &Job{Kind: JobKindBackup, AppID: random.UUID(), Trigger: TriggerDeploy, PgCluster: "pg"}
+	for _, j := range []*Job{running, scheduled} {
+		if err := repo.EnqueueJob(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if j, err := repo.ClaimJob("a", ClaimLimits{}); err != nil || j == nil {
+		t.Fatalf("expected a to claim a scheduled job, got %+v %v", j, err)
+	}
+
+	// nothing but deploy backups are claimed for their slot
+	if j, err := repo.ClaimJob("b", ClaimLimits{DeployOnly: true}); err != nil || j != nil {
+		t.Fatalf("expected no deploy backup to claim, got %+v %v", j, err)
+	}
+	if err := repo.EnqueueJob(deploy); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deploy backup jumps the queue, and the cluster limit
+	j, err := repo.ClaimJob("b", ClaimLimits{Cluster: 1})
+	if err != nil || j == nil || j.JobID != deploy.JobID {
+		t.Fatalf("expected b to claim the deploy backup, got %+v %v", j, err)
+	}
+	if j, err := repo.ClaimJob("c", ClaimLimits{Cluster: 1}); err != nil || j != nil {
+		t.Fatalf("expected the scheduled job to be held back by the cluster limit, got %+v %v", j, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// in-progress backups older than this are assumed to have been abandoned
+	staleBackupAge = 24 * time.Hour
+	// objects without a row are only orphans once they are this old, so
+	// that nothing just written is deleted
+	orphanMinAge = 24 * time.Hour
+)
+
+// with no rows at all, the catalog has more likely been lost than every
+// object orphaned, so nothing is deleted until it's rebuilt
+var errEmptyCatalog = errors.New("pgbackups table is empty, refusing to fix, run \"catalog rebuild\" first")
+
+type SizeMismatch struct {
+	Backup        *Backup
+	RecordedBytes int64
+	StoredBytes   int64
+}
+
+type ReconcileReport struct {
+	// objects in the store without a backup row or a readable manifest
+	OrphanedObjects []*StoredBackup
+	// objects in the store without a backup row but with a manifest, which
+	// "catalog rebuild" restores the rows of.  these are never deleted.
+	UncatalogedObjects []*StoredBackup
+	// objects in the store for backups that failed, were cancelled or were
+	// unchanged, such as what's left of an upload that couldn't be aborted
+	FailedObjects []*StoredBackup
+	// completed backups without an object in the store
+	MissingObjects []*Backup
+	// backups that were started but never completed
+	StaleBackups   []*Backup
+	SizeMismatches []*SizeMismatch
+}
+
+func (r *ReconcileReport) Clean() bool {
+	return len(r.OrphanedObjects) == 0 && len(r.UncatalogedObjects) == 0 && len(r.FailedObjects) == 0 && len(r.MissingObjects) == 0 &&
+		len(r.StaleBackups) == 0 && len(r.SizeMismatches) == 0
+}
+
+// Reconcile compares the store against the backup rows, optionally fixing
+// any differences found
+func (pgb *PgBackups) Reconcile(fix bool) (*ReconcileReport, error) {
+	// the store is listed before the rows are read, so that a backup
+	// completing in the meantime isn't mistaken for a missing object
+	listedAt := time.Now()
+	stored, err := pgb.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	backups, err := pgb.Repo.GetAllBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{}
+
+	rows := make(map[string]*Backup, len(backups))
+	for _, b := range backups {
+		rows[b.BackupID] = b
+	}
+	objects := make(map[string]*StoredBackup, len(stored))
+	for _, o := range stored {
+		objects[o.BackupID] = o
+		if rows[o.BackupID] != nil || o.LastModified.After(listedAt.Add(-orphanMinAge)) {
+			continue
+		}
+		_, err := pgb.Store.GetManifest(o.AppID, o.BackupID)
+		switch {
+		case err == nil:
+			report.UncatalogedObjects = append(report.UncatalogedObjects, o)
+		case isRetryable(err):
+			// the manifest may well be there, so the object is left for
+			// the next run
+			logger.Error("Error reading manifest", "app_id", o.AppID, "backup_id", o.BackupID, "err", err)
+		default:
+			report.OrphanedObjects = append(report.OrphanedObjects, o)
+		}
+	}
+
+	for _, b := range backups {
+		o := objects[b.BackupID]
+		switch {
+		case b.Status == BackupStatusFailed || b.Status == BackupStatusCancelled || b.Status == BackupStatusUnchanged:
+			// nothing should be stored for failed or unchanged backups
+			if o != nil {
+				report.FailedObjects = append(report.FailedObjects, o)
+			}
+		case b.CompletedAt == nil:
+			if b.StartedAt.Before(listedAt.Add(-staleBackupAge)) {
+				report.StaleBackups = append(report.StaleBackups, b)
+			}
+		case b.CompletedAt.After(listedAt):
+			// completed after the store was listed
+		case o == nil:
+			report.MissingObjects = append(report.MissingObjects, b)
+		case o.Bytes != b.Bytes:
+			report.SizeMismatches = append(report.SizeMismatches, &SizeMismatch{Backup: b, RecordedBytes: b.Bytes, StoredBytes: o.Bytes})
+		}
+	}
+
+	if fix {
+		if len(backups) == 0 {
+			return report, errEmptyCatalog
+		}
+		pgb.fixReconcileReport(report)
+	}
+
+	return report, nil
+}
+
+func (pgb *PgBackups) fixReconcileReport(report *ReconcileReport) {
+	// errors are just logged, the next run will pick up anything left over
+	for _, o := range report.OrphanedObjects {
+		if err := pgb.Store.Delete(o.AppID, o.BackupID); err != nil {
+			logger.Error("Error deleting orphaned object", "app_id", o.AppID, "backup_id", o.BackupID, "err", err)
+		}
+	}
+	// the rows are kept, as a record of the backups failing
+	for _, o := range report.FailedObjects {
+		if err := pgb.Store.Delete(o.AppID, o.BackupID); err != nil {
+			logger.Error("Error deleting object of failed backup", "app_id", o.AppID, "backup_id", o.BackupID, "err", err)
+		}
+	}
+	for _, b := range report.MissingObjects {
+		if err := pgb.Repo.DeleteBackup(b); err != nil {
+			b.logger().Error("Error deleting backup without an object", "err", err)
+		}
+	}
+	for _, b := range report.StaleBackups {
+		// a partial object may or may not exist, so errors are ignored
+		pgb.Store.Delete(b.AppID, b.BackupID)
+		if err := pgb.Repo.DeleteBackup(b); err != nil {
+			b.logger().Error("Error deleting stale backup", "err", err)
+		}
+	}
+	for _, m := range report.SizeMismatches {
+		if err := pgb.Repo.UpdateBackupBytes(m.Backup, m.StoredBytes); err != nil {
+			m.Backup.logger().Error("Error updating backup size", "bytes", m.StoredBytes, "err", err)
+		}
+	}
+}
+
+func (pgb *PgBackups) ReconcileAndLog(fix bool) {
+	logger.Info("Starting reconcile")
+	startedAt := time.Now()
+
+	report, err := pgb.Reconcile(fix)
+	if err != nil {
+		logger.Error("Error reconciling", "err", err)
+		return
+	}
+
+	logger.Info("Completed reconcile",
+		"orphaned_objects", len(report.OrphanedObjects),
+		"uncataloged_objects", len(report.UncatalogedObjects),
+		"failed_objects", len(report.FailedObjects),
+		"missing_objects", len(report.MissingObjects),
+		"stale_backups", len(report.StaleBackups),
+		"size_mismatches", len(report.SizeMismatches),
+		"fixed", fix,
+		"duration", time.Since(startedAt))
+}
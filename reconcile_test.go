@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func TestReconcile(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newMemStore()
+	pgb := &PgBackups{Repo: repo, Store: store}
+
+	appID := random.UUID()
+	newBackup := func(size int64, stored bool) *Backup {
+		b, err := repo.NewBackup(appID, "test", TriggerManual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored {
+			if _, err := store.Put(context.Background(), appID, b.BackupID, strings.NewReader(strings.Repeat("x", int(size)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b
+	}
+
+	ok := newBackup(10, true)
+	repo.CompleteBackup(ok, 10, "")
+	missing := newBackup(10, false)
+	repo.CompleteBackup(missing, 10, "")
+	mismatched := newBackup(10, true)
+	repo.CompleteBackup(mismatched, 20, "")
+	stale := newBackup(0, false)
+	if err := db.Exec("UPDATE pgbackups SET started_at = $1 WHERE backup_id = $2", time.Now().Add(-2*staleBackupAge), stale.BackupID); err != nil {
+		t.Fatal(err)
+	}
+	running := newBackup(0, false)
+	failed := newBackup(5, true)
+	repo.FailBackup(failed, errors.New("connection reset by peer"))
+	old := time.Now().Add(-2 * orphanMinAge)
+	orphan := random.UUID()
+	store.Put(context.Background(), appID, orphan, strings.NewReader("orphan"))
+	store.objects[orphan].LastModified = old
+	// too new to be an orphan, it may be a backup whose row is being written
+	recent := random.UUID()
+	store.Put(context.Background(), appID, recent, strings.NewReader("recent"))
+	// with a manifest, the row can be restored by rebuilding the catalog
+	uncataloged := random.UUID()
+	store.Put(context.Background(), appID, uncataloged, strings.NewReader("uncataloged"))
+	store.objects[uncataloged].LastModified = old
+	store.PutManifest(&Manifest{AppID: appID, BackupID: uncataloged})
+
+	report, err := pgb.Reconcile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OrphanedObjects) != 1 || report.OrphanedObjects[0].BackupID != orphan {
+		t.Errorf("expected orphaned object %s, got %v", orphan, report.OrphanedObjects)
+	}
+	if len(report.UncatalogedObjects) != 1 || report.UncatalogedObjects[0].BackupID != uncataloged {
+		t.Errorf("expected uncataloged object %s, got %v", uncataloged, report.UncatalogedObjects)
+	}
+	if len(report.FailedObjects) != 1 || report.FailedObjects[0].BackupID != failed.BackupID {
+		t.Errorf("expected the object of failed backup %s, got %v", failed.BackupID, report.FailedObjects)
+	}
+	if len(report.MissingObjects) != 1 || report.MissingObjects[0].BackupID != missing.BackupID {
+		t.Errorf("expected missing object %s, got %v", missing.BackupID, report.MissingObjects)
+	}
+	if len(report.StaleBackups) != 1 || report.StaleBackups[0].BackupID != stale.BackupID {
+		t.Errorf("expected stale backup %s, got %v", stale.BackupID, report.StaleBackups)
+	}
+	if len(report.SizeMismatches) != 1 || report.SizeMismatches[0].StoredBytes != 10 {
+		t.Errorf("expected size mismatch for %s, got %v", mismatched.BackupID, report.SizeMismatches)
+	}
+
+	if _, err := pgb.Reconcile(true); err != nil {
+		t.Fatal(err)
+	}
+	report, err = pgb.Reconcile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.UncatalogedObjects) != 1 {
+		t.Errorf("expected the uncataloged object to be kept, got %v", report.UncatalogedObjects)
+	}
+	report.UncatalogedObjects = nil
+	if !report.Clean() {
+		t.Errorf("expected a clean report after fixing, got %+v", report)
+	}
+	if _, ok := store.objects[recent]; !ok {
+		t.Error("expected the recent object to be kept")
+	}
+
+	backups, _ := repo.GetBackups(appID)
+	if len(backups) != 4 {
+		t.Errorf("expected 4 backups to remain, got %d", len(backups))
+	}
+
+	for _, b := range []*Backup{ok, mismatched, running, failed} {
+		repo.DeleteBackup(b)
+	}
+}
+
+func TestReconcileEmptyCatalog(t *testing.T) {
+	repo, err := NewBackupRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DELETE FROM pgbackups"); err != nil {
+		t.Fatal(err)
+	}
+	store := newMemStore()
+	pgb := &PgBackups{Repo: repo, Store: store}
+
+	orphan := random.UUID()
+	store.Put(context.Background(), random.UUID(), orphan, strings.NewReader("orphan"))
+	store.objects[orphan].LastModified = time.Now().Add(-2 * orphanMinAge)
+
+	// a lost database mustn't empty the bucket
+	report, err := pgb.Reconcile(true)
+	if err != errEmptyCatalog {
+		t.Errorf("expected errEmptyCatalog, got %v", err)
+	}
+	if report == nil || len(report.OrphanedObjects) != 1 {
+		t.Errorf("expected the orphan to be reported, got %+v", report)
+	}
+	if _, ok := store.objects[orphan]; !ok {
+		t.Error("expected nothing to be deleted")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+type RetryPolicy struct {
+	// total attempts, including the first
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func retryPolicyFromEnv() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: envInt("BACKUP_ATTEMPTS", 3),
+		BaseDelay:   envDuration("BACKUP_RETRY_DELAY", 30*time.Second),
+		MaxDelay:    envDuration("BACKUP_RETRY_MAX_DELAY", 10*time.Minute),
+	}
+}
+
+// Backoff returns how long to wait after the given (1 based) attempt failed.
+// The delay doubles with each attempt up to MaxDelay, and is jittered to
+// somewhere between half and all of that so that backups failing together
+// don't all retry together.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// permanentError marks failures that retrying won't fix, such as an app
+// missing its postgres configuration
+type permanentError struct {
+	error
+}
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// transientError marks failures that retrying may fix, such as pg_dump
+// losing its connection to the database
+type transientError struct {
+	error
+}
+
+func transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+}
+
+// isRetryable classifies errors from the dump job and the store.  Only
+// failures known to be transient are retried, anything unrecognised is
+// assumed to be permanent rather than repeated until the attempts run out.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pe permanentError
+	if errors.As(err, &pe) {
+		return false
+	}
+	var te transientError
+	if errors.As(err, &te) {
+		return true
+	}
+
+	// S3
+	var re *s3gof3r.RespError
+	if errors.As(err, &re) {
+		return re.StatusCode >= 500 || re.StatusCode == 429 || re.StatusCode == 408
+	}
+
+	// flynn controller
+	var je httphelper.JSONError
+	if errors.As(err, &je) {
+		switch je.Code {
+		case httphelper.UnknownErrorCode, httphelper.RatelimitedErrorCode, httphelper.ServiceUnavailableErrorCode:
+			return true
+		}
+		return je.Retry
+	}
+	if err == controller.ErrNotFound {
+		return false
+	}
+
+	// dropped connections, to the controller, the job or S3
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	for _, transient := range []error{io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
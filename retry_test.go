@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/rlmcpherson/s3gof3r"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		for i := 0; i < 20; i++ {
+			d := p.Backoff(attempt)
+			if d < max/2 || d > max {
+				t.Errorf("attempt %d: expected a delay between %s and %s, got %s", attempt, max/2, max, d)
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, e := range []struct {
+		err       error
+		retryable bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		{fmt.Errorf("error streaming dump: %w", io.ErrUnexpectedEOF), true},
+		{errBackupStalled, true},
+		// anything unrecognised isn't retried
+		{errors.New("something unexpected"), false},
+		{&s3gof3r.RespError{StatusCode: 503}, true},
+		{&s3gof3r.RespError{StatusCode: 403}, false},
+		{httphelper.JSONError{Code: httphelper.UnauthorizedErrorCode}, false},
+		{httphelper.JSONError{Code: httphelper.ServiceUnavailableErrorCode}, true},
+		{permanent(errors.New("missing PGHOST in app environment")), false},
+		{nil, false},
+	} {
+		if isRetryable(e.err) != e.retryable {
+			t.Errorf("expected retryable to be %t for %v", e.retryable, e.err)
+		}
+	}
+}
+
+func TestPgDumpError(t *testing.T) {
+	for _, e := range []struct {
+		stderr    string
+		retryable bool
+	}{
+		{`pg_dump: error: connection to server at "10.0.0.1", port 5432 failed: FATAL:  password authentication failed for user "app"`, false},
+		{"pg_dump: error: query failed: ERROR:  permission denied for table secrets", false},
+		{"pg_dump: error: query failed: server closed the connection unexpectedly", true},
+		{"pg_dump: error: could not obtain lock on relation \"users\"", true},
+		{"", false},
+	} {
+		err := pgDumpError(1, e.stderr)
+		if isRetryable(err) != e.retryable {
+			t.Errorf("expected retryable to be %t for %v", e.retryable, err)
+		}
+		if !strings.Contains(err.Error(), e.stderr) {
+			t.Errorf("expected stderr in the error, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/robfig/cron"
+)
+
+func TestAppOffset(t *testing.T) {
+	window := time.Hour
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		appID := random.UUID()
+		offset := appOffset(appID, window)
+		if offset < 0 || offset >= window {
+			t.Errorf("expected an offset within the window, got %s", offset)
+		}
+		if appOffset(appID, window) != offset {
+			t.Error("expected the same app to get the same offset")
+		}
+		seen[offset] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expected apps to be spread across the window")
+	}
+	if offset := appOffset(random.UUID(), 0); offset != 0 {
+		t.Errorf("expected no offset without a window, got %s", offset)
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	sched, err := cron.Parse(defaultCronLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := 20 * time.Minute
+
+	// the tick has passed, but not the app's run
+	now := time.Date(2016, 3, 10, 5, 10, 0, 0, time.Local)
+	if next := nextRun(sched, offset, now); !next.Equal(time.Date(2016, 3, 10, 5, 20, 0, 0, time.Local)) {
+		t.Errorf("expected today's run, got %s", next)
+	}
+	now = time.Date(2016, 3, 10, 5, 30, 0, 0, time.Local)
+	if next := nextRun(sched, offset, now); !next.Equal(time.Date(2016, 3, 11, 5, 20, 0, 0, time.Local)) {
+		t.Errorf("expected tomorrow's run, got %s", next)
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
-	"log"
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/robfig/cron"
 )
@@ -9,10 +13,36 @@ import (
 // 5am UTC, ~midnight EST
 const defaultCronLine string = "0 0 5 * * *"
 
+// the cron ticks this often whatever the schedule, so that a dead cron can be
+// noticed, see Scheduler.LastTick
+const tickCronLine = "@every 30s"
+
 type Scheduler struct {
 	PgBackups *PgBackups
 	CronLine  string
-	cron      *cron.Cron
+	// each app's scheduled runs are offset by up to this much, so that they
+	// don't all start at once, see appOffset
+	Window time.Duration
+	// also back up pgbackups' own database on each scheduled run
+	SelfBackup bool
+	// reconcile is only scheduled when a cron line is given
+	ReconcileCronLine string
+	ReconcileFix      bool
+	// the digest is only emailed when a cron line is given
+	DigestCronLine string
+	// what to do about scheduled runs missed while no worker was leading,
+	// see catchUp
+	CatchupPolicy string
+	// back up apps as their deploys start, see watchDeploys
+	DeployBackups bool
+	cron          *cron.Cron
+	leader        *Lease
+	stopLeader    context.CancelFunc
+	leaderDone    chan struct{}
+	stopOnce      sync.Once
+	stopped       chan struct{}
+	// when the cron last ran on this worker, for health checks
+	lastTick atomic.Int64
 }
 
 func NewScheduler(pgBackups *PgBackups, cronLine string) *Scheduler {
@@ -20,21 +50,179 @@ func NewScheduler(pgBackups *PgBackups, cronLine string) *Scheduler {
 		cronLine = defaultCronLine
 	}
 	return &Scheduler{
-		PgBackups: pgBackups,
-		CronLine:  cronLine,
+		PgBackups:     pgBackups,
+		CronLine:      cronLine,
+		CatchupPolicy: CatchupOnce,
+		DeployBackups: true,
+		stopped:       make(chan struct{}),
 	}
 }
 
 func (s *Scheduler) Run() error {
-	log.Println("Starting scheduler")
+	logger.Info("Starting scheduler", "schedule", s.CronLine, "window", s.Window)
+
+	// every worker runs the cron, but only the leader acts on it
+	var ctx context.Context
+	ctx, s.stopLeader = context.WithCancel(context.Background())
+	s.leader = NewLease(s.PgBackups.Repo, schedulerLease, workerID(), s.PgBackups.LeaseTTL)
+	// a new leader may have taken over from one that died before a run
+	s.leader.onAcquire = func() { go s.catchUp() }
+	s.leaderDone = make(chan struct{})
+	go func() {
+		s.leader.Run(ctx)
+		close(s.leaderDone)
+	}()
+	if s.DeployBackups {
+		go s.watchDeploys(ctx)
+	}
 
 	s.cron = cron.New()
-	s.cron.AddFunc(s.CronLine, s.PgBackups.BackupAll)
+	s.tick()
+	if err := s.cron.AddFunc(tickCronLine, s.tick); err != nil {
+		return err
+	}
+	if err := s.cron.AddFunc(s.CronLine, s.ifLeader(s.runBackups)); err != nil {
+		return err
+	}
+	if err := s.cron.AddFunc("@every 1m", s.ifLeader(s.PgBackups.ReapStaleJobs)); err != nil {
+		return err
+	}
+	if err := s.cron.AddFunc(staleCheckCronLine, s.ifLeader(func() { s.PgBackups.CheckStale(time.Now()) })); err != nil {
+		return err
+	}
+	if s.DigestCronLine != "" {
+		if s.PgBackups.Mailer == nil {
+			logger.Warn("Not sending digests, as SMTP_HOST isn't set")
+		} else if err := s.cron.AddFunc(s.DigestCronLine, s.ifLeader(s.sendDigest)); err != nil {
+			return err
+		}
+	}
+	if s.ReconcileCronLine != "" {
+		err := s.cron.AddFunc(s.ReconcileCronLine, s.ifLeader(func() {
+			s.PgBackups.ReconcileAndLog(s.ReconcileFix)
+		}))
+		if err != nil {
+			return err
+		}
+	}
 
 	s.cron.Start()
 
-	// block forever, as cron runs in another goroutine
-	select {}
-
+	// block until stopped, as cron runs in another goroutine
+	<-s.stopped
 	return nil
 }
+
+// Stop prevents any more scheduled runs and jobs from starting, and drains
+// the jobs already running
+func (s *Scheduler) Stop(grace time.Duration) {
+	s.stopOnce.Do(func() {
+		logger.Info("Stopping scheduler")
+		if s.cron != nil {
+			s.cron.Stop()
+		}
+		s.PgBackups.Drain(grace)
+		// released last, so another worker doesn't start while this one's
+		// backups are still finishing
+		if s.stopLeader != nil {
+			s.stopLeader()
+			<-s.leaderDone
+		}
+		close(s.stopped)
+	})
+}
+
+// NextRuns returns when each app's next scheduled backup will run, after
+// waiting for any of the blackouts, by app id
+func (s *Scheduler) NextRuns(apps []*AppAndRelease, blackouts []*Blackout, now time.Time) (map[string]time.Time, error) {
+	sched, err := cron.Parse(s.CronLine)
+	if err != nil {
+		return nil, err
+	}
+	runs := make(map[string]time.Time, len(apps))
+	for _, a := range apps {
+		run := nextRun(sched, appOffset(a.App.ID, s.Window), now)
+		runs[a.App.ID], _ = blackoutEnd(blackouts, a.App.ID, run)
+	}
+	return runs, nil
+}
+
+// appOffset is how far into the window the app's scheduled backups run.  It
+// is a hash of the app id, so it stays the same from run to run.
+func appOffset(appID string, window time.Duration) time.Duration {
+	// offsets are whole seconds, as cron runs on the second
+	if window < time.Second {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(appID))
+	return time.Duration(h.Sum64()%uint64(window/time.Second)) * time.Second
+}
+
+// nextRun returns the first run of the schedule, delayed by offset, after t
+func nextRun(sched cron.Schedule, offset time.Duration, t time.Time) time.Time {
+	return sched.Next(t.Add(-offset)).Add(offset)
+}
+
+// tick records that the cron is still running, on every worker
+func (s *Scheduler) tick() {
+	s.lastTick.Store(time.Now().UnixNano())
+}
+
+// LastTick returns when the cron last ran, or the zero time if it hasn't
+// been started
+func (s *Scheduler) LastTick() time.Time {
+	t := s.lastTick.Load()
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+func (s *Scheduler) ifLeader(f func()) func() {
+	return func() {
+		if !s.leader.Held() {
+			logger.Debug("Not the scheduler leader, skipping scheduled run")
+			return
+		}
+		f()
+	}
+}
+
+func (s *Scheduler) sendDigest() {
+	if err := s.PgBackups.SendDigest(context.Background(), time.Now()); err != nil {
+		logger.Error("Error sending digest", "err", err)
+		return
+	}
+	logger.Info("Sent digest", "to", s.PgBackups.Mailer.To)
+}
+
+// runBackups queues the scheduled backups, each to run at its app's offset
+// into the window, by whichever workers claim them
+func (s *Scheduler) runBackups() {
+	// cron runs on the second, so this is the time of the scheduled run
+	tick := time.Now().Truncate(time.Second)
+
+	apps, err := s.PgBackups.AppsToBackUp()
+	if err != nil {
+		logger.Error("Error obtaining app list", "err", err)
+	}
+	queued := 0
+	for _, a := range apps {
+		j := newAppJob(JobKindBackup, a, TriggerSchedule)
+		runAt := tick.Add(appOffset(a.App.ID, s.Window))
+		j.RunAt = &runAt
+		if err := s.PgBackups.Repo.EnqueueJob(j); err != nil {
+			logger.Error("Error queueing backup", "app", a.App.Name, "app_id", a.App.ID, "err", err)
+			continue
+		}
+		queued++
+	}
+	logger.Info("Queued scheduled backups", "count", queued)
+
+	if s.SelfBackup {
+		if _, err := s.PgBackups.EnqueueSelfBackup(TriggerSchedule); err != nil {
+			logger.Error("Error queueing pgbackups database backup", "err", err)
+		}
+	}
+}
@@ -20,5 +20,121 @@ func migrate(db *postgres.DB) error {
 
 		`CREATE INDEX ON pgbackups (app_id)`)
 
+	m.Add(2,
+		`ALTER TABLE pgbackups ADD COLUMN app_name text`,
+		`ALTER TABLE pgbackups ADD COLUMN checksum text`,
+		`ALTER TABLE pgbackups ADD COLUMN format text`)
+
+	m.Add(3,
+		`ALTER TABLE pgbackups ADD COLUMN status text NOT NULL DEFAULT 'running'`,
+		`UPDATE pgbackups SET status = 'completed' WHERE completed_at IS NOT NULL`,
+		`ALTER TABLE pgbackups ADD COLUMN error text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups ADD COLUMN attempts integer NOT NULL DEFAULT 0`,
+
+		`CREATE TABLE pgbackups_attempts (
+		backup_id uuid NOT NULL REFERENCES pgbackups (backup_id) ON DELETE CASCADE,
+		attempt integer NOT NULL,
+		started_at timestamptz NOT NULL,
+		finished_at timestamptz NOT NULL DEFAULT now(),
+		error text NOT NULL DEFAULT '',
+		retryable boolean NOT NULL DEFAULT false,
+		PRIMARY KEY (backup_id, attempt)
+	)`)
+
+	m.Add(4,
+		`CREATE TABLE pgbackups_leases (
+		name text PRIMARY KEY,
+		holder text NOT NULL,
+		expires_at timestamptz NOT NULL
+	)`)
+
+	m.Add(5,
+		`CREATE TABLE pgbackups_jobs (
+		job_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		kind text NOT NULL,
+		app_id uuid,
+		backup_id uuid,
+		trigger text NOT NULL DEFAULT 'manual',
+		pg_host text NOT NULL DEFAULT '',
+		pg_cluster text NOT NULL DEFAULT '',
+		status text NOT NULL DEFAULT 'queued',
+		run_at timestamptz NOT NULL DEFAULT now(),
+		worker_id text,
+		heartbeat_at timestamptz,
+		attempts integer NOT NULL DEFAULT 0,
+		error text NOT NULL DEFAULT '',
+		created_at timestamptz NOT NULL DEFAULT now(),
+		started_at timestamptz,
+		finished_at timestamptz
+	)`,
+
+		`CREATE INDEX ON pgbackups_jobs (status, run_at)`,
+
+		`ALTER TABLE pgbackups ADD COLUMN trigger text NOT NULL DEFAULT 'schedule'`,
+		`ALTER TABLE pgbackups ADD COLUMN verified_at timestamptz`,
+		`ALTER TABLE pgbackups ADD COLUMN verify_error text NOT NULL DEFAULT ''`)
+
+	m.Add(6,
+		`CREATE TABLE pgbackups_blackouts (
+		blackout_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+		app_id uuid,
+		schedule text NOT NULL DEFAULT '',
+		duration_seconds integer NOT NULL DEFAULT 0,
+		starts_at timestamptz,
+		ends_at timestamptz,
+		reason text NOT NULL DEFAULT '',
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`)
+
+	m.Add(7,
+		`ALTER TABLE pgbackups ADD COLUMN release_id text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups ADD COLUMN deploy_release_id text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups_jobs ADD COLUMN release_id text NOT NULL DEFAULT ''`)
+
+	m.Add(8,
+		`ALTER TABLE pgbackups ADD COLUMN change_marker text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups ADD COLUMN same_as uuid`)
+
+	m.Add(9,
+		`ALTER TABLE pgbackups ADD COLUMN pinned boolean NOT NULL DEFAULT false`)
+
+	m.Add(10,
+		`ALTER TABLE pgbackups_jobs ADD COLUMN phase text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups_jobs ADD COLUMN progress_bytes bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE pgbackups_jobs ADD COLUMN bytes_per_second bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE pgbackups_jobs ADD COLUMN progress_at timestamptz`)
+
+	m.Add(11,
+		`ALTER TABLE pgbackups ADD COLUMN log text NOT NULL DEFAULT ''`)
+
+	m.Add(12,
+		`ALTER TABLE pgbackups ADD COLUMN compression text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups ADD COLUMN pg_version text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups ADD COLUMN pg_dump_version text NOT NULL DEFAULT ''`,
+		`ALTER TABLE pgbackups ADD COLUMN stderr text NOT NULL DEFAULT ''`)
+
+	m.Add(13,
+		`CREATE TABLE pgbackups_sessions (
+		session_hash text PRIMARY KEY,
+		key_hash text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		expires_at timestamptz NOT NULL
+	)`)
+
+	m.Add(14,
+		`CREATE TABLE pgbackups_counters (
+		name text NOT NULL,
+		app text NOT NULL,
+		value double precision NOT NULL DEFAULT 0,
+		PRIMARY KEY (name, app)
+	)`)
+
+	m.Add(15,
+		`CREATE TABLE pgbackups_stale_reports (
+		app_id uuid PRIMARY KEY,
+		last_success_at timestamptz NOT NULL,
+		reported_at timestamptz NOT NULL DEFAULT now()
+	)`)
+
 	return m.Migrate(db)
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+const defaultSelfBackupRetain = 14
+
+// selfApp describes the pgbackups app itself, using the postgres
+// configuration from its own environment
+func (pgb *PgBackups) selfApp() (*AppAndRelease, error) {
+	appID := os.Getenv("FLYNN_APP_ID")
+	if appID == "" {
+		return nil, errors.New("FLYNN_APP_ID is not set, unable to identify the pgbackups app")
+	}
+	app, err := pgb.FlynnClient.GetApp(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	for _, k := range []string{"FLYNN_POSTGRES", "PGHOST", "PGUSER", "PGPASSWORD", "PGDATABASE"} {
+		env[k] = os.Getenv(k)
+	}
+
+	return &AppAndRelease{App: app, Release: &ct.Release{Env: env}}, nil
+}
+
+// BackupSelf dumps the pgbackups database to its own prefix in the store.
+// These backups have no rows, as they need to be usable when the database
+// is lost, so they are found and pruned by listing the store.
+func (pgb *PgBackups) BackupSelf(ctx context.Context, progress *jobProgress) (*StoredBackup, error) {
+	app, err := pgb.selfApp()
+	if err != nil {
+		return nil, err
+	}
+
+	backupID := random.UUID()
+
+	// tracked so that shutdown waits for it
+	ctx, done := pgb.track(ctx, backupID)
+	defer done()
+
+	progress.SetPhase(PhaseDumping)
+	bytes, _, err := pgb.streamToStore(ctx, app, pgb.SelfStore, backupID, progress, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StoredBackup{AppID: app.App.ID, BackupID: backupID, Bytes: bytes}, nil
+}
+
+// ListSelfBackups returns the stored self backups, newest first
+func (pgb *PgBackups) ListSelfBackups() ([]*StoredBackup, error) {
+	stored, err := pgb.SelfStore.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(byLastModified(stored)))
+	return stored, nil
+}
+
+func (pgb *PgBackups) latestSelfBackup() (*StoredBackup, error) {
+	stored, err := pgb.ListSelfBackups()
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		return nil, errors.New("no self backups found")
+	}
+	return stored[0], nil
+}
+
+func (pgb *PgBackups) DeleteOldSelfBackups() error {
+	retain := envInt("SELF_BACKUP_RETAIN", defaultSelfBackupRetain)
+	if retain < 1 {
+		retain = defaultSelfBackupRetain
+	}
+
+	stored, err := pgb.ListSelfBackups()
+	if err != nil {
+		return err
+	}
+	for i := retain; i < len(stored); i++ {
+		if err := pgb.SelfStore.Delete(stored[i].AppID, stored[i].BackupID); err != nil {
+			// just log
+			logger.Error("Error deleting self backup", "backup_id", stored[i].BackupID, "err", err)
+		}
+	}
+	return nil
+}
+
+// RestoreSelf restores the pgbackups database from the given self backup,
+// or the most recent one if backupID is empty
+func (pgb *PgBackups) RestoreSelf(backupID string) error {
+	app, err := pgb.selfApp()
+	if err != nil {
+		return err
+	}
+
+	if backupID == "" {
+		latest, err := pgb.latestSelfBackup()
+		if err != nil {
+			return err
+		}
+		backupID = latest.BackupID
+	}
+
+	r, err := pgb.SelfStore.Get(app.App.ID, backupID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return pgb.FlynnClient.StreamRestore(context.Background(), app, r)
+}
+
+func (pgb *PgBackups) BackupSelfAndPrune(ctx context.Context, progress *jobProgress) error {
+	logger.Info("Backing up pgbackups database")
+	startedAt := time.Now()
+
+	b, err := pgb.BackupSelf(ctx, progress)
+	if err != nil {
+		return err
+	}
+	logger.Info("Completed backing up pgbackups database", "backup_id", b.BackupID, "bytes", b.Bytes, "duration", time.Since(startedAt))
+
+	progress.SetPhase(PhasePruning)
+	if err := pgb.DeleteOldSelfBackups(); err != nil {
+		logger.Error("Error deleting old self backups", "err", err)
+	}
+	return nil
+}
+
+type byLastModified []*StoredBackup
+
+func (s byLastModified) Len() int           { return len(s) }
+func (s byLastModified) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastModified) Less(i, j int) bool { return s[i].LastModified.Before(s[j].LastModified) }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// selfStoreWith returns a store holding self backups last modified a day
+// apart, oldest first
+func selfStoreWith(appID string, n int) (*memStore, []string) {
+	store := newMemStore()
+	ids := make([]string, n)
+	start := time.Now().Add(-time.Duration(n) * 24 * time.Hour)
+	for i := range ids {
+		ids[i] = random.UUID()
+		store.objects[ids[i]] = &StoredBackup{AppID: appID, BackupID: ids[i], LastModified: start.Add(time.Duration(i) * 24 * time.Hour)}
+	}
+	return store, ids
+}
+
+func TestDeleteOldSelfBackups(t *testing.T) {
+	appID := random.UUID()
+	selfStore, ids := selfStoreWith(appID, 5)
+	appStore, appIDs := selfStoreWith(random.UUID(), 5)
+	pgb := &PgBackups{Store: appStore, SelfStore: selfStore}
+
+	os.Setenv("SELF_BACKUP_RETAIN", "3")
+	defer os.Unsetenv("SELF_BACKUP_RETAIN")
+	if err := pgb.DeleteOldSelfBackups(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the newest are kept
+	if len(selfStore.objects) != 3 {
+		t.Errorf("expected 3 self backups to be kept, got %d", len(selfStore.objects))
+	}
+	for i, id := range ids {
+		if _, kept := selfStore.objects[id]; kept != (i >= 2) {
+			t.Errorf("expected self backup %d kept to be %t", i, i >= 2)
+		}
+	}
+	// app backups are in their own store, which isn't pruned
+	for _, id := range appIDs {
+		if _, ok := appStore.objects[id]; !ok {
+			t.Errorf("expected app backup %s to be untouched", id)
+		}
+	}
+}
+
+func TestLatestSelfBackup(t *testing.T) {
+	store, ids := selfStoreWith(random.UUID(), 3)
+	pgb := &PgBackups{SelfStore: store}
+	latest, err := pgb.latestSelfBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.BackupID != ids[2] {
+		t.Errorf("expected the newest self backup %s, got %s", ids[2], latest.BackupID)
+	}
+
+	pgb.SelfStore = newMemStore()
+	if _, err := pgb.latestSelfBackup(); err == nil {
+		t.Error("expected an error with no self backups")
+	}
+}
+
+func TestSelfStorePaths(t *testing.T) {
+	// the stores share a bucket, so neither may see the other's objects
+	appStore := &s3store{prefix: storePrefix}
+	selfStore := &s3store{prefix: selfStorePrefix}
+	appID, backupID := random.UUID(), random.UUID()
+
+	if _, _, ok := appStore.parsePath(selfStore.pathFor(appID, backupID)); ok {
+		t.Error("expected the app store not to parse a self backup's path")
+	}
+	if _, _, ok := selfStore.parsePath(appStore.pathFor(appID, backupID)); ok {
+		t.Error("expected the self store not to parse an app backup's path")
+	}
+	if a, b, ok := selfStore.parsePath(selfStore.pathFor(appID, backupID)); !ok || a != appID || b != backupID {
+		t.Errorf("expected %s/%s, got %s/%s", appID, backupID, a, b)
+	}
+}
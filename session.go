@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+)
+
+const defaultSessionTTL = 12 * time.Hour
+
+// dashboard sessions are random ids, stored hashed along with a hash of the
+// API key used to log in, so a session ends when it expires, when it's
+// logged out of, or when its key is removed from API_KEYS
+func hashToken(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a session for key, returning its id
+func (r *BackupRepo) CreateSession(key string, ttl time.Duration) (string, error) {
+	// expired sessions are cleared out as new ones start
+	if err := r.db.Exec("DELETE FROM pgbackups_sessions WHERE expires_at < now()"); err != nil {
+		return "", err
+	}
+	id := random.Hex(32)
+	return id, r.db.Exec("INSERT INTO pgbackups_sessions (session_hash, key_hash, expires_at) VALUES ($1, $2, now() + $3 * interval '1 millisecond')",
+		hashToken(id), hashToken(key), int64(ttl/time.Millisecond))
+}
+
+// SessionKeyHash returns the hash of the key the session was started with,
+// or "" if there is no such session or it has expired
+func (r *BackupRepo) SessionKeyHash(id string) (string, error) {
+	var keyHash string
+	err := r.db.QueryRow("SELECT coalesce((SELECT key_hash FROM pgbackups_sessions WHERE session_hash = $1 AND expires_at > now()), '')", hashToken(id)).Scan(&keyHash)
+	return keyHash, err
+}
+
+func (r *BackupRepo) DeleteSession(id string) error {
+	return r.db.Exec("DELETE FROM pgbackups_sessions WHERE session_hash = $1", hashToken(id))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+)
+
+// how long cancelled backups are given to stop and record their state
+const cancelWait = 30 * time.Second
+
+// Drain stops new jobs from being claimed and waits up to grace for running
+// jobs to finish, after which any backups still running are cancelled.  It
+// waits for RunJobs to return rather than for the backups to stop, so that
+// what the jobs write once their backups stop, such as their outcome, the
+// backup's log and app lease releases, is written before the process exits.
+func (pgb *PgBackups) Drain(grace time.Duration) {
+	pgb.draining.Store(true)
+	// backups ending now may still be notifying
+	defer pgb.waitForNotifications(notifyWait)
+
+	if n := pgb.running.count(); n > 0 {
+		logger.Info("Waiting for running backups to finish", "count", n, "grace", grace)
+	}
+	if pgb.waitForWorkers(grace) {
+		return
+	}
+
+	logger.Warn("Cancelling running backups", "count", pgb.running.count())
+	pgb.running.cancelAll(errWorkerShutdown)
+	if !pgb.waitForWorkers(cancelWait) {
+		logger.Error("Backups did not stop in time", "count", pgb.running.count())
+	}
+}
+
+func (pgb *PgBackups) Draining() bool {
+	return pgb.draining.Load()
+}
+
+// waitForWorkers returns whether RunJobs returned within timeout
+func (pgb *PgBackups) waitForWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pgb.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
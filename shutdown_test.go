@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	pgb := &PgBackups{}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	pgb.running.add("running", cancel)
+	var requeued atomic.Bool
+	pgb.workers.Add(1)
+	go func() {
+		defer pgb.workers.Done()
+		// a backup that only stops when cancelled
+		<-ctx.Done()
+		pgb.running.remove("running")
+		// with its job given back to the queue after it stops
+		time.Sleep(50 * time.Millisecond)
+		requeued.Store(true)
+	}()
+
+	pgb.Drain(100 * time.Millisecond)
+
+	if !pgb.Draining() {
+		t.Error("expected to be draining")
+	}
+	if context.Cause(ctx) != errWorkerShutdown {
+		t.Errorf("expected the running backup to be cancelled with %s, got %v", errWorkerShutdown, context.Cause(ctx))
+	}
+	if pgb.running.count() != 0 {
+		t.Errorf("expected no running backups, got %d", pgb.running.count())
+	}
+	if !requeued.Load() {
+		t.Error("expected Drain to wait for the job to be requeued")
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/AdRoll/goamz/aws"
@@ -11,20 +14,45 @@ import (
 	"github.com/rlmcpherson/s3gof3r"
 )
 
+const (
+	storePrefix = "pgbackups"
+	// backups of pgbackups' own database are kept apart from app backups
+	selfStorePrefix = "pgbackups-self"
+)
+
+type StoredBackup struct {
+	AppID        string
+	BackupID     string
+	Bytes        int64
+	LastModified time.Time
+}
+
 type Storer interface {
 	DownloadUrl(appId string, backupId string) (string, error)
-	// return bytes written
-	Put(appId string, backupId string, r io.Reader) (int64, error)
+	// return bytes written.  nothing is left stored if ctx is cancelled.
+	Put(ctx context.Context, appId string, backupId string, r io.Reader) (int64, error)
+	Get(appId string, backupId string) (io.ReadCloser, error)
 	Delete(appId string, backupId string) error
+	// return every backup object in the store
+	List() ([]*StoredBackup, error)
+	// manifests are stored alongside each backup, so the catalog can be
+	// rebuilt from the store alone
+	PutManifest(m *Manifest) error
+	GetManifest(appId string, backupId string) (*Manifest, error)
+	// check that the store can be reached, for health checks
+	Ping() error
+	// where the backup and its manifest are stored, for people to find them
+	Locations(appId string, backupId string) []string
 }
 
 type s3store struct {
 	bucketName string
 	bucket     *s3gof3r.Bucket
 	regionName string
+	prefix     string
 }
 
-func NewS3Store(bucketName string, regionName string) (Storer, error) {
+func NewS3Store(bucketName string, regionName string, prefix string) (Storer, error) {
 	keys, err := s3gof3r.EnvKeys()
 	if err != nil {
 		return nil, err
@@ -34,37 +62,202 @@ func NewS3Store(bucketName string, regionName string) (Storer, error) {
 	s3 := s3gof3r.New(s3Domain, keys)
 	bucket := s3.Bucket(bucketName)
 
-	return &s3store{bucketName: bucketName, bucket: bucket, regionName: regionName}, nil
+	return &s3store{bucketName: bucketName, bucket: bucket, regionName: regionName, prefix: prefix}, nil
 }
 
 func (s *s3store) DownloadUrl(appId string, backupId string) (string, error) {
-	auth, err := aws.EnvAuth()
+	b, err := s.amzBucket()
 	if err != nil {
 		return "", err
 	}
-	svc := s3.New(auth, aws.GetRegion(s.regionName))
-	b := svc.Bucket(s.bucketName)
 	return b.SignedURL(s.pathFor(appId, backupId), time.Now().Add(20*time.Minute)), nil
 }
 
-func (s *s3store) Put(appId string, backupId string, r io.Reader) (int64, error) {
+func (s *s3store) Put(ctx context.Context, appId string, backupId string, r io.Reader) (int64, error) {
 	s3Path := s.pathFor(appId, backupId)
 
 	s3Putter, err := s.bucket.PutWriter(s3Path, nil, nil)
 	if err != nil {
 		return -1, err
 	}
-	defer s3Putter.Close()
 
-	return io.Copy(s3Putter, r)
+	// reads only notice ctx between parts, so the upload is aborted as soon
+	// as ctx is done, failing a put blocked on uploading parts
+	putDone := make(chan struct{})
+	abortDone := make(chan struct{})
+	go func() {
+		defer close(abortDone)
+		select {
+		case <-ctx.Done():
+			if err := s.abortUpload(s3Path); err != nil {
+				logger.Error("Error aborting upload", "path", s3Path, "err", err)
+			}
+		case <-putDone:
+		}
+	}()
+	defer func() {
+		close(putDone)
+		<-abortDone
+	}()
+
+	n, err := io.Copy(s3Putter, &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		// closing would complete the upload with whatever was written, but
+		// once it's aborted closing only releases the putter.  if it can't
+		// be aborted the partial object is removed after closing, and any
+		// left behind is found by reconcile.
+		if aerr := s.abortUpload(s3Path); aerr != nil {
+			logger.Error("Error aborting upload", "path", s3Path, "err", aerr)
+			s3Putter.Close()
+			s.bucket.Delete(s3Path)
+			return n, err
+		}
+		s3Putter.Close()
+		return n, err
+	}
+
+	if err := s3Putter.Close(); err != nil {
+		return n, err
+	}
+	// ctx was done as the upload completed
+	if ctx.Err() != nil {
+		s.bucket.Delete(s3Path)
+		return n, context.Cause(ctx)
+	}
+	return n, nil
+}
+
+// abortUpload aborts the multipart uploads to path, discarding their parts
+func (s *s3store) abortUpload(path string) error {
+	b, err := s.amzBucket()
+	if err != nil {
+		return err
+	}
+	multis, _, err := b.ListMulti(path, "")
+	if err != nil {
+		return err
+	}
+	for _, m := range multis {
+		if m.Key != path {
+			continue
+		}
+		if err := m.Abort(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3store) Get(appId string, backupId string) (io.ReadCloser, error) {
+	r, _, err := s.bucket.GetReader(s.pathFor(appId, backupId), nil)
+	return r, err
 }
 
 func (s *s3store) Delete(appId string, backupId string) error {
-	return s.bucket.Delete(s.pathFor(appId, backupId))
+	if err := s.bucket.Delete(s.pathFor(appId, backupId)); err != nil {
+		return err
+	}
+	return s.bucket.Delete(s.manifestPathFor(appId, backupId))
+}
+
+func (s *s3store) PutManifest(m *Manifest) error {
+	b, err := s.amzBucket()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.Put(s.manifestPathFor(m.AppID, m.BackupID), data, "application/json", s3.Private, s3.Options{})
 }
 
-func (*s3store) pathFor(appId string, backupId string) string {
-	return fmt.Sprintf("pgbackups/%s/%s.backup", appId, backupId)
+func (s *s3store) GetManifest(appId string, backupId string) (*Manifest, error) {
+	b, err := s.amzBucket()
+	if err != nil {
+		return nil, err
+	}
+	data, err := b.Get(s.manifestPathFor(appId, backupId))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *s3store) List() ([]*StoredBackup, error) {
+	b, err := s.amzBucket()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*StoredBackup{}
+	marker := ""
+	for {
+		resp, err := b.List(s.prefix+"/", "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range resp.Contents {
+			marker = k.Key
+			appId, backupId, ok := s.parsePath(k.Key)
+			if !ok {
+				continue
+			}
+			modified, _ := time.Parse(time.RFC3339Nano, k.LastModified)
+			result = append(result, &StoredBackup{AppID: appId, BackupID: backupId, Bytes: k.Size, LastModified: modified})
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *s3store) Ping() error {
+	b, err := s.amzBucket()
+	if err != nil {
+		return err
+	}
+	_, err = b.List(s.prefix+"/", "", "", 1)
+	return err
+}
+
+// s3gof3r doesn't do signing or listing, so goamz is used for those
+func (s *s3store) amzBucket() (*s3.Bucket, error) {
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return nil, err
+	}
+	svc := s3.New(auth, aws.GetRegion(s.regionName))
+	return svc.Bucket(s.bucketName), nil
+}
+
+func (s *s3store) Locations(appId string, backupId string) []string {
+	return []string{
+		fmt.Sprintf("s3://%s/%s", s.bucketName, s.pathFor(appId, backupId)),
+		fmt.Sprintf("s3://%s/%s", s.bucketName, s.manifestPathFor(appId, backupId)),
+	}
+}
+
+func (s *s3store) pathFor(appId string, backupId string) string {
+	return fmt.Sprintf("%s/%s/%s.backup", s.prefix, appId, backupId)
+}
+
+func (s *s3store) manifestPathFor(appId string, backupId string) string {
+	return fmt.Sprintf("%s/%s/%s.json", s.prefix, appId, backupId)
+}
+
+// inverse of pathFor
+func (s *s3store) parsePath(path string) (string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, s.prefix+"/"), "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[1], ".backup") {
+		return "", "", false
+	}
+	return parts[0], strings.TrimSuffix(parts[1], ".backup"), true
 }
 
 func getRegion(regionName string) string {
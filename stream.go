@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errBackupTimedOut = permanent(errors.New("backup timed out"))
+	errBackupStalled  = transient(errors.New("backup stalled, no data received"))
+)
+
+// streamToStore streams stdout from a dump job of the app to the store,
+// returning the bytes stored and their checksum, and counting them into
+// progress as they go.  The start of the dump and the job's stderr are kept
+// in details, if given.  The job and the upload are torn down if ctx is
+// cancelled, or if no data is received for the stall timeout.
+func (pgb *PgBackups) streamToStore(ctx context.Context, app *AppAndRelease, store Storer, backupID string, progress *jobProgress, details *dumpDetails) (int64, string, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var bytes int64
+
+	r, w := io.Pipe()
+	watched := newWatchedReader(r)
+	watched.progress = progress
+	go pgb.watchForStall(ctx, cancel, watched)
+
+	errChan := make(chan error, 2)
+
+	hash := sha256.New()
+	var tee io.Writer = hash
+	var stderr io.Writer = os.Stderr
+	if details != nil {
+		tee = io.MultiWriter(hash, &details.head)
+		stderr = &details.stderr
+	}
+
+	go func() {
+		err := pgb.FlynnClient.StreamBackup(ctx, app, w, stderr)
+		// the store sees the error rather than the end of the dump, so a
+		// failed dump is never completed as a truncated object
+		w.CloseWithError(err)
+		errChan <- err
+	}()
+
+	go func() {
+		defer r.Close()
+		var err error
+		bytes, err = store.Put(ctx, app.App.ID, backupID, io.TeeReader(watched, tee))
+		errChan <- err
+	}()
+
+	// both sides are always waited for, as cancelling ctx tears down the job
+	// and the upload.  this way a retry can't race with the removal of this
+	// attempt's partial upload.
+	var streamErr error
+	for i := 0; i < 2; i++ {
+		if err := <-errChan; err != nil && streamErr == nil {
+			streamErr = err
+			cancel(err)
+		}
+	}
+	if streamErr != nil {
+		return bytes, "", context.Cause(ctx)
+	}
+
+	return bytes, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (pgb *PgBackups) watchForStall(ctx context.Context, cancel context.CancelCauseFunc, r *watchedReader) {
+	if pgb.StallTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(pgb.StallTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(r.LastRead()) > pgb.StallTimeout {
+				cancel(errBackupStalled)
+				return
+			}
+		}
+	}
+}
+
+// watchedReader records how much has been read and when, so that stalled
+// streams can be detected
+type watchedReader struct {
+	r        io.Reader
+	bytes    int64
+	lastRead int64
+	progress *jobProgress
+}
+
+func newWatchedReader(r io.Reader) *watchedReader {
+	return &watchedReader{r: r, lastRead: time.Now().UnixNano()}
+}
+
+func (w *watchedReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&w.bytes, int64(n))
+		atomic.StoreInt64(&w.lastRead, time.Now().UnixNano())
+		w.progress.Add(int64(n))
+	}
+	return n, err
+}
+
+func (w *watchedReader) Bytes() int64 {
+	return atomic.LoadInt64(&w.bytes)
+}
+
+func (w *watchedReader) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&w.lastRead))
+}
+
+// contextReader fails reads once ctx is done, so that a cancelled stream is
+// never mistaken for a complete one
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	n, err := c.r.Read(p)
+	if cerr := c.ctx.Err(); cerr != nil {
+		return n, context.Cause(c.ctx)
+	}
+	return n, err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r := &contextReader{ctx: ctx, r: strings.NewReader("some data")}
+
+	buf := make([]byte, 4)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel(errBackupStalled)
+	if _, err := io.Copy(ioutil.Discard, r); err != errBackupStalled {
+		t.Errorf("expected %s, got %v", errBackupStalled, err)
+	}
+}
+
+func TestWatchedReader(t *testing.T) {
+	r := newWatchedReader(strings.NewReader("some data"))
+	before := r.LastRead()
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Bytes() != 9 {
+		t.Errorf("expected 9 bytes read, got %d", r.Bytes())
+	}
+	if r.LastRead().Before(before) {
+		t.Error("expected last read time to advance")
+	}
+}
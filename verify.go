@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VerifyBackup reads a completed backup back from the store and checks it
+// against its recorded size and checksum, recording the result
+func (pgb *PgBackups) VerifyBackup(ctx context.Context, b *Backup, progress *jobProgress) error {
+	if b.Status != BackupStatusCompleted {
+		return permanent(errors.New("backup is not completed, it is " + b.Status))
+	}
+
+	r, err := pgb.Store.Get(b.AppID, b.BackupID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	progress.SetPhase(PhaseVerifying)
+	hash := sha256.New()
+	bytes, err := io.Copy(hash, &contextReader{ctx: ctx, r: &progressReader{r: r, progress: progress}})
+	if err != nil {
+		// not a verdict on the backup, so nothing is recorded
+		return err
+	}
+
+	var verr error
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if bytes != b.Bytes {
+		verr = permanent(fmt.Errorf("stored size %d does not match recorded size %d", bytes, b.Bytes))
+	} else if b.Checksum != "" && checksum != b.Checksum {
+		verr = permanent(fmt.Errorf("stored checksum %s does not match recorded checksum %s", checksum, b.Checksum))
+	}
+
+	if err := pgb.Repo.RecordVerification(b, verr); err != nil {
+		return err
+	}
+	return verr
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	WebhookFormatJSON  = "json"
+	WebhookFormatSlack = "slack"
+
+	webhookTimeout = 10 * time.Second
+)
+
+// WebhookConfig is an entry of the WEBHOOKS JSON array
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// signs the body, see webhookNotifier.Notify
+	Secret string `json:"secret"`
+	// json (the default) or slack
+	Format string `json:"format"`
+	NotifyFilter
+}
+
+// parseWebhooks reads the WEBHOOKS JSON array
+func parseWebhooks(s string) ([]*WebhookConfig, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var configs []*WebhookConfig
+	if err := json.Unmarshal([]byte(s), &configs); err != nil {
+		return nil, fmt.Errorf("error parsing WEBHOOKS: %s", err)
+	}
+	for _, c := range configs {
+		if c.URL == "" {
+			return nil, fmt.Errorf("error parsing WEBHOOKS: every webhook needs a url")
+		}
+		if c.Format == "" {
+			c.Format = WebhookFormatJSON
+		}
+		if c.Format != WebhookFormatJSON && c.Format != WebhookFormatSlack {
+			return nil, fmt.Errorf("error parsing WEBHOOKS: unknown format %q for %s", c.Format, c.URL)
+		}
+		if err := c.NotifyFilter.Validate(); err != nil {
+			return nil, fmt.Errorf("error parsing WEBHOOKS: %s", err)
+		}
+	}
+	return configs, nil
+}
+
+type webhookNotifier struct {
+	config *WebhookConfig
+	client *http.Client
+	retry  RetryPolicy
+}
+
+func newWebhookNotifier(c *WebhookConfig) *webhookNotifier {
+	return &webhookNotifier{config: c, client: &http.Client{Timeout: webhookTimeout}, retry: notifyRetry}
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Fields []slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// slackColors match how bad each event is
+var slackColors = map[string]string{
+	EventFailed:      "danger",
+	EventStale:       "danger",
+	EventSizeAnomaly: "warning",
+	EventSucceeded:   "good",
+	EventRecovered:   "good",
+}
+
+func slackPayload(e *Event) *slackMessage {
+	fields := []slackField{{Title: "App", Value: e.AppName, Short: true}, {Title: "Event", Value: e.Event, Short: true}}
+	if e.BackupID != "" {
+		fields = append(fields, slackField{Title: "Backup", Value: e.BackupID})
+	}
+	if e.Error != "" {
+		fields = append(fields, slackField{Title: "Error", Value: e.Error})
+	}
+	return &slackMessage{
+		Text:        e.Message,
+		Attachments: []slackAttachment{{Color: slackColors[e.Event], Fields: fields}},
+	}
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the timestamp, a ".", and body
+// keyed with secret, sent as "sha256=<signature>" in the X-Pgbackups-Signature
+// header.  The timestamp is signed too so that receivers can refuse old
+// requests, which would otherwise be replayable forever.
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify posts the event, retrying failed requests and 5xx or 429 responses
+func (w *webhookNotifier) Notify(ctx context.Context, e *Event) error {
+	var payload interface{} = e
+	if w.config.Format == WebhookFormatSlack {
+		payload = slackPayload(e)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return retryNotify(ctx, w.retry, func() error {
+		return w.post(ctx, e, body)
+	})
+}
+
+func (w *webhookNotifier) post(ctx context.Context, e *Event, body []byte) error {
+	req, err := http.NewRequest("POST", w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "flynn-pgbackups")
+	req.Header.Set("X-Pgbackups-Event", e.Event)
+	if w.config.Secret != "" {
+		// each attempt is signed when it's sent
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Pgbackups-Timestamp", timestamp)
+		req.Header.Set("X-Pgbackups-Signature", "sha256="+webhookSignature(w.config.Secret, timestamp, body))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		err := fmt.Errorf("webhook %s responded %s", w.config.URL, res.Status)
+		if res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return permanent(err)
+		}
+		return transient(err)
+	}
+	return nil
+}